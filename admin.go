@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// calibrationAdmin serves the remote calibration endpoints. Sensor loops are
+// registered once their ports are open, which happens after the HTTP server
+// has started.
+type calibrationAdmin struct {
+	token string
+	lock  calibrationLock
+	// calibrating serializes the lockout check, the command and recording
+	// its time, so two requests can't both pass the check.
+	calibrating sync.Mutex
+
+	mu    sync.Mutex
+	loops []*sensorLoop
+}
+
+// initCalibrationAdmin reads HTTP_ADMIN_TOKEN. Without it the endpoints
+// refuse every request, since calibration is destructive.
+func initCalibrationAdmin() *calibrationAdmin {
+	token := os.Getenv("HTTP_ADMIN_TOKEN")
+	if token != "" {
+		log.Printf("Remote calibration enabled on /calibrate/zero and /calibrate/span")
+	}
+	return &calibrationAdmin{token: token, lock: initCalibrationLock()}
+}
+
+func (a *calibrationAdmin) register(s *sensorLoop) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.loops = append(a.loops, s)
+}
+
+// sensor returns the loop named by the sensor query parameter, or the only
+// loop when there is just one.
+func (a *calibrationAdmin) sensor(r *http.Request) (*sensorLoop, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := r.URL.Query().Get("sensor")
+	if id == "" {
+		if len(a.loops) != 1 {
+			return nil, fmt.Errorf("sensor parameter required with %d sensors", len(a.loops))
+		}
+		return a.loops[0], nil
+	}
+	for _, s := range a.loops {
+		if s.id == id {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown sensor %q", id)
+}
+
+func (a *calibrationAdmin) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// handleZero serves POST /calibrate/zero.
+func (a *calibrationAdmin) handleZero(w http.ResponseWriter, r *http.Request) {
+	if !a.allowed(w, r, http.MethodPost) {
+		return
+	}
+	a.calibrate(w, r, "zero", calibrateZero)
+}
+
+// handleSpan serves POST /calibrate/span?ppm=N.
+func (a *calibrationAdmin) handleSpan(w http.ResponseWriter, r *http.Request) {
+	if !a.allowed(w, r, http.MethodPost) {
+		return
+	}
+	ppm, err := strconv.ParseUint(r.URL.Query().Get("ppm"), 10, 16)
+	if err != nil || ppm < minSpanPPM || ppm > maxSpanPPM {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("ppm must be between %d and %d", minSpanPPM, maxSpanPPM)})
+		return
+	}
+	a.calibrate(w, r, fmt.Sprintf("span %d ppm", ppm), func(dev io.ReadWriter) error {
+		return calibrateSpan(dev, uint16(ppm))
+	})
+}
+
+// allowed checks the method and token, writing the error response if the
+// request is refused.
+func (a *calibrationAdmin) allowed(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return false
+	}
+	if a.token == "" {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin endpoints disabled; set HTTP_ADMIN_TOKEN"})
+		return false
+	}
+	if !a.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing bearer token"})
+		return false
+	}
+	return true
+}
+
+// calibrate runs the sensor and lockout checks and then send with the
+// sensor's loop paused, so the command can't interleave with a read.
+func (a *calibrationAdmin) calibrate(w http.ResponseWriter, r *http.Request, name string, send func(io.ReadWriter) error) {
+	s, err := a.sensor(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	a.calibrating.Lock()
+	defer a.calibrating.Unlock()
+	if err := a.lock.check(time.Now(), force); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	err = send(s.port)
+	s.mu.Unlock()
+	if err != nil {
+		s.logger.Error("remote calibration failed", "calibration", name, "error", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	s.logger.Warn("remote calibration performed", "calibration", name, "remote", r.RemoteAddr)
+	if err := a.lock.record(time.Now()); err != nil {
+		s.logger.Error("failed to record calibration time", "error", err)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "calibration": name})
+}
+
+// rawFrames holds the last bytes any sensor answered with, whether or not
+// they made a reading.
+var rawFrames rawFrameRecorder
+
+type rawFrameRecorder struct {
+	mu    sync.Mutex
+	frame []byte
+	err   error
+	time  time.Time
+}
+
+func (r *rawFrameRecorder) record(frame []byte, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frame = append(r.frame[:0], frame...)
+	r.err = err
+	r.time = time.Now()
+}
+
+func (r *rawFrameRecorder) get() (frame []byte, timestamp time.Time, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.frame...), r.time, r.err
+}
+
+type debugFrame struct {
+	Frame string `json:"frame"`
+	// The checksums are only set for a complete frame.
+	ReceivedChecksum string    `json:"received_checksum,omitempty"`
+	ComputedChecksum string    `json:"computed_checksum,omitempty"`
+	ChecksumOK       bool      `json:"checksum_ok"`
+	SensorID         string    `json:"sensor_id,omitempty"`
+	Timestamp        time.Time `json:"timestamp"`
+}
+
+func newDebugFrame(frame []byte, timestamp time.Time) *debugFrame {
+	resp := &debugFrame{Frame: fmt.Sprintf("% x", frame), Timestamp: timestamp}
+	if len(frame) == cmdSize {
+		computed := checksum(frame)
+		resp.ReceivedChecksum = fmt.Sprintf("%02x", frame[8])
+		resp.ComputedChecksum = fmt.Sprintf("%02x", computed)
+		resp.ChecksumOK = frame[8] == computed
+	}
+	return resp
+}
+
+// debugFrameResponse is the last raw frame with the error it produced, if
+// any, and separately the frame behind the latest accepted reading.
+type debugFrameResponse struct {
+	*debugFrame
+	Error   string      `json:"error,omitempty"`
+	Reading *debugFrame `json:"reading,omitempty"`
+}
+
+// debugFrameHandler serves GET /debug/frame for remote support: the last
+// bytes received, even if they were rejected, and the frame behind the latest
+// reading.
+func (a *calibrationAdmin) debugFrameHandler(latest *latestReading) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowed(w, r, http.MethodGet) {
+			return
+		}
+		frame, timestamp, err := rawFrames.get()
+		if len(frame) == 0 {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no response received yet"})
+			return
+		}
+		resp := debugFrameResponse{debugFrame: newDebugFrame(frame, timestamp)}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if result, timestamp, ok := latest.Get(); ok {
+			resp.Reading = newDebugFrame(result.Frame[:], timestamp)
+			resp.Reading.SensorID = result.Tags["sensor_id"]
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// routes registers the calibration endpoints on mux.
+func (a *calibrationAdmin) routes(mux *http.ServeMux) {
+	mux.HandleFunc("/calibrate/zero", a.handleZero)
+	mux.HandleFunc("/calibrate/span", a.handleSpan)
+}
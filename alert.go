@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	alertStateNormal = "normal"
+	alertStateHigh   = "high"
+)
+
+const webhookTimeout = 10 * time.Second
+
+type co2AlertPayload struct {
+	Co2       float32   `json:"co2"`
+	Timestamp time.Time `json:"timestamp"`
+	State     string    `json:"state"`
+}
+
+// co2Alerter posts to a webhook when CO2 rises above highPPM and again when
+// it falls back below clearPPM. The gap between the two thresholds keeps a
+// reading hovering around the limit from flapping.
+type co2Alerter struct {
+	url      string
+	highPPM  float32
+	clearPPM float32
+	state    string
+	client   *http.Client
+}
+
+// Observe updates the alert state with a new reading and fires the webhook
+// only on a state transition.
+func (a *co2Alerter) Observe(co2 float32, timestamp time.Time) {
+	next := a.state
+	switch a.state {
+	case alertStateNormal:
+		if co2 > a.highPPM {
+			next = alertStateHigh
+		}
+	case alertStateHigh:
+		if co2 < a.clearPPM {
+			next = alertStateNormal
+		}
+	}
+	if next == a.state {
+		return
+	}
+	a.state = next
+	slog.Warn("CO2 alert state changed", "state", next, "co2", co2)
+	payload := co2AlertPayload{Co2: co2, Timestamp: timestamp, State: next}
+	// Post asynchronously so a slow webhook doesn't delay the next read.
+	go func() {
+		if err := postJSON(a.client, a.url, payload); err != nil {
+			slog.Error("error sending CO2 alert", "state", payload.State, "error", err)
+		}
+	}()
+}
+
+func postJSON(client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post to webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// initCo2Alerter returns nil unless both CO2_ALERT_PPM and CO2_ALERT_WEBHOOK
+// are set. CO2_ALERT_CLEAR_PPM defaults to 100ppm below the alert threshold.
+func initCo2Alerter() *co2Alerter {
+	url := os.Getenv("CO2_ALERT_WEBHOOK")
+	highStr := os.Getenv("CO2_ALERT_PPM")
+	if url == "" || highStr == "" {
+		return nil
+	}
+	high, err := strconv.ParseFloat(highStr, 32)
+	if err != nil || high <= 0 {
+		log.Printf("Invalid CO2_ALERT_PPM value: %q, disabling CO2 alerts", highStr)
+		return nil
+	}
+	clearPPM := high - 100
+	if clearStr, found := os.LookupEnv("CO2_ALERT_CLEAR_PPM"); found {
+		parsed, err := strconv.ParseFloat(clearStr, 32)
+		if err != nil || parsed >= high {
+			log.Printf("Invalid CO2_ALERT_CLEAR_PPM value: %q, must be below CO2_ALERT_PPM; defaulting to %.0f", clearStr, clearPPM)
+		} else {
+			clearPPM = parsed
+		}
+	}
+	log.Printf("CO2 alerts enabled: high above %.0f ppm, clear below %.0f ppm", high, clearPPM)
+	return &co2Alerter{
+		url:      url,
+		highPPM:  float32(high),
+		clearPPM: float32(clearPPM),
+		state:    alertStateNormal,
+		client:   &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+const (
+	failureStateFailing   = "failing"
+	failureStateRecovered = "recovered"
+)
+
+const defaultFailureAlertThreshold = 10
+
+type failureAlertPayload struct {
+	State               string    `json:"state"`
+	SensorID            string    `json:"sensor_id,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error"`
+	Timestamp           time.Time `json:"timestamp"`
+}
+
+// failureAlerter raises one alert when consecutive read failures reach
+// threshold and one more when a read succeeds again. The alert is always
+// logged and also posted to url when it is set.
+type failureAlerter struct {
+	url       string
+	threshold int
+	sensorID  string
+	failures  int
+	lastErr   error
+	alerting  bool
+	client    *http.Client
+}
+
+// Failure records a failed read and alerts when it crosses the threshold.
+func (a *failureAlerter) Failure(err error, timestamp time.Time) {
+	a.failures++
+	a.lastErr = err
+	if a.alerting || a.failures < a.threshold {
+		return
+	}
+	a.alerting = true
+	slog.Error("sensor has stopped answering", "consecutive_failures", a.failures, "last_error", err)
+	a.post(failureStateFailing, timestamp)
+}
+
+// Success resets the failure count and alerts if the sensor had been
+// reported as failing.
+func (a *failureAlerter) Success(timestamp time.Time) {
+	if a.alerting {
+		a.alerting = false
+		slog.Info("sensor has recovered", "consecutive_failures", a.failures, "last_error", a.lastErr)
+		a.post(failureStateRecovered, timestamp)
+	}
+	a.failures = 0
+	a.lastErr = nil
+}
+
+func (a *failureAlerter) post(state string, timestamp time.Time) {
+	if a.url == "" {
+		return
+	}
+	payload := failureAlertPayload{
+		State:               state,
+		SensorID:            a.sensorID,
+		ConsecutiveFailures: a.failures,
+		LastError:           a.lastErr.Error(),
+		Timestamp:           timestamp,
+	}
+	go func() {
+		if err := postJSON(a.client, a.url, payload); err != nil {
+			slog.Error("error sending failure alert", "state", payload.State, "error", err)
+		}
+	}()
+}
+
+// initFailureAlerter reads FAILURE_ALERT_WEBHOOK and FAILURE_ALERT_THRESHOLD
+// (default 10). Without a webhook the alerts are only logged.
+func initFailureAlerter(sensorID string) *failureAlerter {
+	threshold := defaultFailureAlertThreshold
+	if thresholdStr, found := os.LookupEnv("FAILURE_ALERT_THRESHOLD"); found {
+		parsed, err := strconv.Atoi(thresholdStr)
+		if err != nil || parsed < 1 {
+			log.Printf("Invalid FAILURE_ALERT_THRESHOLD value: %q, defaulting to %d", thresholdStr, defaultFailureAlertThreshold)
+		} else {
+			threshold = parsed
+		}
+	}
+	return &failureAlerter{
+		url:       os.Getenv("FAILURE_ALERT_WEBHOOK"),
+		threshold: threshold,
+		sensorID:  sensorID,
+		client:    &http.Client{Timeout: webhookTimeout},
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCo2AlerterIgnoresWarmup(t *testing.T) {
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+	}))
+	defer srv.Close()
+
+	replay := newReplayPort([][]byte{frame(2500, 24)}, true)
+	d := newTestDaemon(t, replay, &recordingSink{})
+	d.warm = warmup{start: time.Now(), duration: time.Hour}
+	s := d.loops[0]
+	s.alerter = &co2Alerter{url: srv.URL, highPPM: 1500, clearPPM: 1400, state: alertStateNormal, client: srv.Client()}
+
+	if err := d.runOnce(context.Background()); err != nil {
+		t.Fatalf("runOnce returned error: %v", err)
+	}
+	if s.alerter.state != alertStateNormal {
+		t.Errorf("alert state during warm-up = %s, want %s", s.alerter.state, alertStateNormal)
+	}
+
+	d.warm.duration = 0
+	if err := d.runOnce(context.Background()); err != nil {
+		t.Fatalf("runOnce returned error: %v", err)
+	}
+	if s.alerter.state != alertStateHigh {
+		t.Errorf("alert state after warm-up = %s, want %s", s.alerter.state, alertStateHigh)
+	}
+	deadline := time.Now().Add(time.Second)
+	for posts.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := posts.Load(); got != 1 {
+		t.Errorf("webhook received %d posts, want 1", got)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// diskBuffer is an append-only file of line-protocol records that could not
+// be written to InfluxDB. The file is capped at maxBytes by dropping the
+// oldest lines.
+type diskBuffer struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+}
+
+func (b *diskBuffer) Append(lines ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(b.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create buffer directory: %v", err)
+	}
+	f, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open buffer file %s: %v", b.path, err)
+	}
+	for _, line := range lines {
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to append to buffer file %s: %v", b.path, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close buffer file %s: %v", b.path, err)
+	}
+	return b.truncateLocked()
+}
+
+// Drain passes every buffered line, oldest first, to replay. The file is
+// first claimed by renaming it, so the lock isn't held while replaying: a
+// failed async batch appends to the buffer from the client's own goroutine,
+// which replay may be waiting on. Lines appended meanwhile go to a fresh
+// file. If replay fails, the claimed lines are merged back ahead of them.
+// It returns the number of lines replayed.
+func (b *diskBuffer) Drain(replay func(lines []string) error) (int, error) {
+	lines, err := b.claim()
+	if err != nil || len(lines) == 0 {
+		return 0, err
+	}
+	if err := replay(lines); err != nil {
+		if err := b.unclaim(lines); err != nil {
+			slog.Error("error restoring buffered points, data lost", "error", err)
+		}
+		return 0, err
+	}
+	if err := os.Remove(b.claimedPath()); err != nil && !os.IsNotExist(err) {
+		return len(lines), fmt.Errorf("failed to clear buffer file %s: %v", b.claimedPath(), err)
+	}
+	return len(lines), nil
+}
+
+// claimedPath is where Drain moves the buffer while replaying it. A file left
+// there by a crash mid-replay is picked up by the next Drain.
+func (b *diskBuffer) claimedPath() string {
+	return b.path + ".draining"
+}
+
+func (b *diskBuffer) claim() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	claimed, err := readLines(b.claimedPath())
+	if err != nil {
+		return nil, err
+	}
+	pending, err := readLines(b.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return claimed, nil
+	}
+	if len(claimed) == 0 {
+		if err := os.Rename(b.path, b.claimedPath()); err != nil {
+			return nil, fmt.Errorf("failed to claim buffer file %s: %v", b.path, err)
+		}
+		return pending, nil
+	}
+	lines := append(claimed, pending...)
+	if err := writeLines(b.claimedPath(), lines); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(b.path); err != nil {
+		return nil, fmt.Errorf("failed to claim buffer file %s: %v", b.path, err)
+	}
+	return lines, nil
+}
+
+// unclaim puts lines back in front of whatever was appended since claim.
+func (b *diskBuffer) unclaim(lines []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pending, err := readLines(b.path)
+	if err != nil {
+		return err
+	}
+	if err := writeLines(b.path, append(lines, pending...)); err != nil {
+		return err
+	}
+	if err := os.Remove(b.claimedPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear buffer file %s: %v", b.claimedPath(), err)
+	}
+	return b.truncateLocked()
+}
+
+// readLines returns the non-empty lines of the file at path, or nil if it
+// doesn't exist.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open buffer file %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read buffer file %s: %v", path, err)
+	}
+	return lines, nil
+}
+
+// writeLines replaces the file at path with lines, through a temporary file
+// so a crash can't leave it half-written.
+func writeLines(path string, lines []string) error {
+	tmp := path + ".tmp"
+	data := ""
+	if len(lines) > 0 {
+		data = strings.Join(lines, "\n") + "\n"
+	}
+	if err := os.WriteFile(tmp, []byte(data), 0o644); err != nil {
+		return fmt.Errorf("failed to rewrite buffer file %s: %v", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace buffer file %s: %v", path, err)
+	}
+	return nil
+}
+
+// truncateLocked drops the oldest lines until the file fits in maxBytes.
+func (b *diskBuffer) truncateLocked() error {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat buffer file %s: %v", b.path, err)
+	}
+	if info.Size() <= b.maxBytes {
+		return nil
+	}
+	lines, err := readLines(b.path)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	dropped := 0
+	for dropped < len(lines) && size > b.maxBytes {
+		size -= int64(len(lines[dropped]) + 1)
+		dropped++
+	}
+	slog.Warn("buffer file full, dropping oldest lines", "max_bytes", b.maxBytes, "dropped", dropped)
+	return writeLines(b.path, lines[dropped:])
+}
+
+// bufferedWriter spools points that fail to write into a diskBuffer and
+// replays the buffer ahead of the next point.
+type bufferedWriter struct {
+	next      pointWriter
+	buffer    *diskBuffer
+	precision time.Duration
+}
+
+func (w *bufferedWriter) WritePoint(ctx context.Context, point ...*write.Point) error {
+	var replayErr error
+	drained, err := w.buffer.Drain(func(lines []string) error {
+		if err := w.next.WriteRecord(ctx, lines...); err != nil {
+			replayErr = fmt.Errorf("failed to drain %d buffered line(s): %w", len(lines), err)
+			return replayErr
+		}
+		return nil
+	})
+	if replayErr != nil {
+		w.spool(point)
+		return replayErr
+	}
+	if err != nil {
+		slog.Error("error draining buffered points", "error", err)
+	}
+	if drained > 0 {
+		log.Printf("Drained %d buffered line(s)", drained)
+	}
+	if err := w.next.WritePoint(ctx, point...); err != nil {
+		w.spool(point)
+		return err
+	}
+	return nil
+}
+
+func (w *bufferedWriter) WriteRecord(ctx context.Context, line ...string) error {
+	return w.next.WriteRecord(ctx, line...)
+}
+
+func (w *bufferedWriter) spool(points []*write.Point) {
+	lines := make([]string, 0, len(points))
+	for _, p := range points {
+		lines = append(lines, strings.TrimSuffix(write.PointToLineProtocol(p, w.precision), "\n"))
+	}
+	if err := w.buffer.Append(lines...); err != nil {
+		slog.Error("error buffering points to disk, data lost", "error", err)
+		return
+	}
+	log.Printf("Buffered %d point(s) to %s", len(lines), w.buffer.path)
+}
+
+const defaultBufferMaxBytes = 10 * 1024 * 1024
+
+// initDiskBuffer returns nil when buffering is disabled with an empty
+// BUFFER_FILE.
+func initDiskBuffer() *diskBuffer {
+	path, found := os.LookupEnv("BUFFER_FILE")
+	if !found {
+		path = "/var/lib/mhz19c/pending.lp"
+	}
+	if path == "" {
+		return nil
+	}
+	maxBytes := int64(defaultBufferMaxBytes)
+	if maxStr, found := os.LookupEnv("BUFFER_MAX_BYTES"); found {
+		parsed, err := strconv.ParseInt(maxStr, 10, 64)
+		if err != nil || parsed <= 0 {
+			log.Printf("Invalid BUFFER_MAX_BYTES value: %q, defaulting to %d", maxStr, defaultBufferMaxBytes)
+		} else {
+			maxBytes = parsed
+		}
+	}
+	return &diskBuffer{path: path, maxBytes: maxBytes}
+}
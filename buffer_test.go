@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// drainWithTimeout fails the test instead of hanging if Drain deadlocks.
+func drainWithTimeout(t *testing.T, b *diskBuffer, replay func([]string) error) (int, error) {
+	t.Helper()
+	type drained struct {
+		n   int
+		err error
+	}
+	done := make(chan drained, 1)
+	go func() {
+		n, err := b.Drain(replay)
+		done <- drained{n, err}
+	}()
+	select {
+	case d := <-done:
+		return d.n, d.err
+	case <-time.After(2 * time.Second):
+		t.Fatal("Drain deadlocked")
+		return 0, nil
+	}
+}
+
+func TestDiskBufferDrainReentrantAppend(t *testing.T) {
+	b := &diskBuffer{path: filepath.Join(t.TempDir(), "pending.lp"), maxBytes: defaultBufferMaxBytes}
+	if err := b.Append("a", "b"); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+
+	// A failing async batch lands back in the buffer from the client's
+	// goroutine while the replay is still in progress.
+	errDown := errors.New("server down")
+	_, err := drainWithTimeout(t, b, func(lines []string) error {
+		if err := b.Append("c"); err != nil {
+			t.Errorf("Append during Drain returned error: %v", err)
+		}
+		return errDown
+	})
+	if !errors.Is(err, errDown) {
+		t.Errorf("Drain error = %v, want %v", err, errDown)
+	}
+	lines, err := readLines(b.path)
+	if err != nil {
+		t.Fatalf("readLines returned error: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("buffer after failed drain = %q, want %q", lines, want)
+	}
+
+	n, err := drainWithTimeout(t, b, func(lines []string) error {
+		return b.Append("d")
+	})
+	if err != nil || n != 3 {
+		t.Errorf("Drain = %d, %v; want 3, nil", n, err)
+	}
+	if lines, _ := readLines(b.path); !reflect.DeepEqual(lines, []string{"d"}) {
+		t.Errorf("buffer after drain = %q, want only the line appended meanwhile", lines)
+	}
+}
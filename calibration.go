@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultCalibrationMinInterval = 24 * time.Hour
+
+// calibrationLock refuses calibrations that follow the previous one within
+// minInterval, since repeated zero calibration degrades the sensor. The time
+// of the last successful calibration is kept in a state file so the lockout
+// survives restarts and cron-driven runs.
+type calibrationLock struct {
+	path        string
+	minInterval time.Duration
+}
+
+func initCalibrationLock() calibrationLock {
+	path, found := os.LookupEnv("CALIBRATION_STATE_FILE")
+	if !found || path == "" {
+		path = "/var/lib/mhz19c/last-calibration"
+	}
+	interval := defaultCalibrationMinInterval
+	if intervalStr, found := os.LookupEnv("CALIBRATION_MIN_INTERVAL"); found {
+		parsed, err := time.ParseDuration(intervalStr)
+		if err != nil || parsed < 0 {
+			log.Printf("Invalid CALIBRATION_MIN_INTERVAL value: %q, defaulting to %v", intervalStr, defaultCalibrationMinInterval)
+		} else {
+			interval = parsed
+		}
+	}
+	return calibrationLock{path: path, minInterval: interval}
+}
+
+// last returns the time of the last recorded calibration, or the zero time
+// if none has been recorded.
+func (l calibrationLock) last() (time.Time, error) {
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read calibration state file %s: %v", l.path, err)
+	}
+	last, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse calibration state file %s: %v", l.path, err)
+	}
+	return last, nil
+}
+
+// check returns an error if a calibration ran within minInterval, unless
+// force is set.
+func (l calibrationLock) check(now time.Time, force bool) error {
+	last, err := l.last()
+	if err != nil {
+		if force {
+			log.Printf("Ignoring unreadable calibration state because of --force: %v", err)
+			return nil
+		}
+		return err
+	}
+	if last.IsZero() {
+		return nil
+	}
+	if since := now.Sub(last); since < l.minInterval {
+		if force {
+			log.Printf("WARNING: last calibration was %v ago; continuing because of --force", since.Round(time.Second))
+			return nil
+		}
+		return fmt.Errorf("refusing to calibrate: last calibration was at %s, less than CALIBRATION_MIN_INTERVAL (%v) ago; pass --force to override", last.Format(time.RFC3339), l.minInterval)
+	}
+	return nil
+}
+
+// record stores now as the time of the last calibration.
+func (l calibrationLock) record(now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create calibration state directory: %v", err)
+	}
+	if err := os.WriteFile(l.path, []byte(now.Format(time.RFC3339)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write calibration state file %s: %v", l.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const programName = "sensor-to-db"
+
+// command is a subcommand selected by the first command-line argument. Each
+// one parses its own flags from args.
+type command struct {
+	name, usage, summary string
+	run                  func(args []string)
+}
+
+var commands []command
+
+func init() {
+	// Assigned here rather than in the declaration because help refers
+	// back to commands.
+	commands = []command{
+		{"run", "[flags]", "read the sensors and send readings until stopped (the default)", runMain},
+		{"read", "[flags]", "take a single reading and print it to stdout", readMain},
+		{"calibrate", "zero|span [flags]", "send a zero-point or span calibration command", calibrateMain},
+		{"probe", "[flags]", "list serial ports and check which answers like an MH-Z19C", probeMain},
+		{"version", "[flags]", "print version information", versionMain},
+		{"help", "", "show this help", func([]string) { printUsage(os.Stdout) }},
+	}
+}
+
+// dispatch runs the subcommand named by args[0]. Without one, or when args
+// starts with a flag, it runs the daemon so existing invocations keep
+// working.
+func dispatch(args []string) {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name == name {
+			c.run(args)
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", programName, name)
+	printUsage(os.Stderr)
+	os.Exit(2)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", programName)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", programName)
+}
+
+// newFlagSet returns the flag set of the named subcommand. withSettings adds
+// the flags overriding environment settings; call parseFlags to parse it.
+func newFlagSet(name string, withSettings bool) *flag.FlagSet {
+	fs := flag.NewFlagSet(programName+" "+name, flag.ExitOnError)
+	for _, c := range commands {
+		if c.name == name {
+			fs.Usage = func() {
+				fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n\n%s\n\nFlags:\n", programName, c.name, c.usage, c.summary)
+				fs.PrintDefaults()
+			}
+		}
+	}
+	if withSettings {
+		registerSettingFlags(fs)
+	}
+	return fs
+}
+
+// parseFlags parses args into fs and records the setting flags given.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	// With ExitOnError, Parse exits on invalid flags.
+	_ = fs.Parse(args)
+	applySettingFlags(fs)
+}
+
+func runMain(args []string) {
+	fs := newFlagSet("run", true)
+	oneshot := fs.Bool("oneshot", false, "read and send once, then exit with a nonzero status on failure")
+	// Kept from before the subcommands existed.
+	calibrateZero := fs.Bool("calibrate-zero", false, "deprecated: use 'calibrate zero'")
+	calibrateSpan := fs.Uint("calibrate-span", 0, "deprecated: use 'calibrate span --ppm'")
+	force := fs.Bool("force", false, "deprecated: use 'calibrate --force'")
+	version := fs.Bool("version", false, "deprecated: use 'version'")
+	versionSensor := fs.Bool("version-sensor", false, "deprecated: use 'version --sensor'")
+	parseFlags(fs, args)
+
+	switch {
+	case *version:
+		fmt.Println(versionString())
+		return
+	case *versionSensor:
+		runVersionSensor()
+		return
+	case *calibrateZero:
+		runCalibrateZero(*force)
+		return
+	case *calibrateSpan != 0:
+		runCalibrateSpan(*calibrateSpan, *force)
+		return
+	}
+	log.Print(versionString())
+	runDaemon(initOneshot(*oneshot))
+}
+
+func readMain(args []string) {
+	fs := newFlagSet("read", true)
+	parseFlags(fs, args)
+
+	co2Field, err := initCo2FieldName()
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := initConn()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	result, err := read(c, buildCommand(), initReadConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	result.Time = time.Now().In(initLocation())
+	if err := newStdoutSink(co2Field).Write(context.Background(), &result); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func calibrateMain(args []string) {
+	if len(args) == 0 || (args[0] != "zero" && args[0] != "span") {
+		fmt.Fprintf(os.Stderr, "Usage: %s calibrate zero|span [flags]\n", programName)
+		os.Exit(2)
+	}
+	kind, args := args[0], args[1:]
+	fs := newFlagSet("calibrate", true)
+	force := fs.Bool("force", false, "calibrate even within CALIBRATION_MIN_INTERVAL of the last calibration")
+	var ppm *uint
+	if kind == "span" {
+		ppm = fs.Uint("ppm", 0, fmt.Sprintf("concentration of the reference gas (%d-%d), required", minSpanPPM, maxSpanPPM))
+	}
+	parseFlags(fs, args)
+
+	if kind == "zero" {
+		runCalibrateZero(*force)
+		return
+	}
+	runCalibrateSpan(*ppm, *force)
+}
+
+func probeMain(args []string) {
+	fs := newFlagSet("probe", true)
+	parseFlags(fs, args)
+
+	ports, err := serial.GetPortsList()
+	if err != nil {
+		log.Fatalf("failed to get serial ports: %v", err)
+	}
+	if len(ports) == 0 {
+		log.Fatal("no serial ports found")
+	}
+	mode := initSerialMode()
+	found := false
+	for _, name := range ports {
+		status := "no response"
+		if probePort(name, mode, probeReadConfig) {
+			status = "MH-Z19C"
+			found = true
+		}
+		fmt.Printf("%s\t%s\n", name, status)
+	}
+	if !found {
+		os.Exit(1)
+	}
+}
+
+func versionMain(args []string) {
+	fs := newFlagSet("version", true)
+	sensor := fs.Bool("sensor", false, "print the sensor firmware version instead")
+	parseFlags(fs, args)
+
+	if *sensor {
+		runVersionSensor()
+		return
+	}
+	fmt.Println(versionString())
+}
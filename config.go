@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// settingFlags maps command-line flags to the environment variable each one
+// overrides. Resolution order is flag, then environment, then the built-in
+// default applied by the corresponding init* helper.
+var settingFlags = []struct {
+	flag, env, usage string
+}{
+	{"uart", "UART_DEV", "serial device of the sensor (overrides UART_DEV)"},
+	{"baud", "UART_BAUD", "serial baud rate (overrides UART_BAUD)"},
+	{"interval", "SLEEP_DURATION_SECONDS", "seconds between reads (overrides SLEEP_DURATION_SECONDS)"},
+	{"org", "INFLUXDB_ORG", "InfluxDB organization (overrides INFLUXDB_ORG)"},
+	{"bucket", "INFLUXDB_BUCKET", "InfluxDB bucket (overrides INFLUXDB_BUCKET)"},
+	{"url", "INFLUXDB_URL", "InfluxDB URL (overrides INFLUXDB_URL)"},
+	{"gzip", "INFLUXDB_GZIP", "gzip InfluxDB write requests (true/false): costs a little CPU per write but shrinks line protocol several-fold, worth it on slow or metered uplinks (overrides INFLUXDB_GZIP)"},
+}
+
+// flagOverrides holds the values of setting flags given on the command line,
+// keyed by environment variable name.
+var flagOverrides = map[string]string{}
+
+// registerSettingFlags defines the setting flags on fs. Call
+// applySettingFlags after fs has been parsed.
+func registerSettingFlags(fs *flag.FlagSet) {
+	for _, s := range settingFlags {
+		fs.String(s.flag, "", s.usage)
+	}
+}
+
+// applySettingFlags records every setting flag that was explicitly set.
+func applySettingFlags(fs *flag.FlagSet) {
+	flagEnv := map[string]string{}
+	for _, s := range settingFlags {
+		flagEnv[s.flag] = s.env
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if env, ok := flagEnv[f.Name]; ok {
+			flagOverrides[env] = f.Value.String()
+		}
+	})
+}
+
+// lookupEnv is os.LookupEnv with command-line overrides applied.
+func lookupEnv(key string) (string, bool) {
+	if value, ok := flagOverrides[key]; ok {
+		return value, true
+	}
+	return os.LookupEnv(key)
+}
+
+// settingSource reports where the value of env came from.
+func settingSource(env string) string {
+	if _, ok := flagOverrides[env]; ok {
+		return "flag"
+	}
+	if envFileKeys[env] {
+		return "env file"
+	}
+	if _, ok := os.LookupEnv(env); ok {
+		return "env"
+	}
+	return "default"
+}
+
+// effectiveConfig is the resolved configuration reported at startup.
+type effectiveConfig struct {
+	UARTDevices []string
+	SerialMode  *serial.Mode
+	Interval    time.Duration
+	Info        InfluxDBInfo
+	Location    *time.Location
+	OutputMode  string
+}
+
+// redact hides secrets while still showing whether they are set.
+func redact(secret string) string {
+	if secret == "" {
+		return "(unset)"
+	}
+	return "****"
+}
+
+// logEffectiveConfig prints every resolved setting so deployments can verify
+// which values were picked up. Secrets are redacted.
+func logEffectiveConfig(cfg effectiveConfig) {
+	uart := strings.Join(cfg.UARTDevices, ",")
+	if uart == "" {
+		uart, _ = lookupEnv("UART_DEV")
+		if uart == "" {
+			uart = "(first available port)"
+		}
+	}
+	tags := make([]string, 0, len(cfg.Info.Tags))
+	for k, v := range cfg.Info.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	slices.Sort(tags)
+
+	log.Printf("Config: UART device: %s (%s)", uart, settingSource("UART_DEV"))
+	log.Printf("Config: baud rate: %d (%s)", cfg.SerialMode.BaudRate, settingSource("UART_BAUD"))
+	log.Printf("Config: serial framing: %s", serialFraming(cfg.SerialMode))
+	intervalSource := settingSource("SLEEP_DURATION_SECONDS")
+	if _, err := parseInterval(os.Getenv("INTERVAL")); err == nil && intervalSource != "flag" {
+		intervalSource = "env INTERVAL"
+	}
+	log.Printf("Config: interval: %v (%s)", cfg.Interval, intervalSource)
+	log.Printf("Config: output mode: %s", cfg.OutputMode)
+	log.Printf("Config: InfluxDB version: %d", cfg.Info.Version)
+	log.Printf("Config: InfluxDB URL: %s (%s)", cfg.Info.URL, settingSource("INFLUXDB_URL"))
+	log.Printf("Config: InfluxDB org: %s (%s)", cfg.Info.Org, settingSource("INFLUXDB_ORG"))
+	log.Printf("Config: InfluxDB bucket: %s (%s)", cfg.Info.Bucket, settingSource("INFLUXDB_BUCKET"))
+	log.Printf("Config: InfluxDB token: %s", redact(os.Getenv("INFLUXDB_TOKEN")))
+	if path := os.Getenv("INFLUXDB_TOKEN_FILE"); path != "" {
+		log.Printf("Config: InfluxDB token file: %s", path)
+	}
+	if cfg.Info.Version == 1 {
+		log.Printf("Config: InfluxDB username: %s", os.Getenv("INFLUXDB_USERNAME"))
+		log.Printf("Config: InfluxDB password: %s", redact(os.Getenv("INFLUXDB_PASSWORD")))
+	}
+	log.Printf("Config: measurement: %s", cfg.Info.Measurement)
+	if cfg.Info.TemperatureMeasurement != "" {
+		log.Printf("Config: temperature measurement: %s", cfg.Info.TemperatureMeasurement)
+	}
+	log.Printf("Config: tags: %s", strings.Join(tags, ","))
+	log.Printf("Config: timezone: %s", cfg.Location)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// co2Correction is a linear software calibration applied to every reading,
+// for users who compare the sensor against a reference instrument.
+type co2Correction struct {
+	scale  float32
+	offset float32
+}
+
+// Apply returns v*scale + offset.
+func (c *co2Correction) Apply(v float32) float32 {
+	return v*c.scale + c.offset
+}
+
+// initCo2Correction reads CO2_SCALE (default 1.0) and CO2_OFFSET (default
+// 0.0). It returns nil when the correction would leave readings unchanged.
+func initCo2Correction() *co2Correction {
+	c := co2Correction{scale: 1}
+	if scaleStr, found := os.LookupEnv("CO2_SCALE"); found {
+		scale, err := strconv.ParseFloat(scaleStr, 32)
+		if err != nil || scale <= 0 {
+			log.Printf("Invalid CO2_SCALE value: %q, must be a positive number; defaulting to 1.0", scaleStr)
+		} else {
+			c.scale = float32(scale)
+		}
+	}
+	if offsetStr, found := os.LookupEnv("CO2_OFFSET"); found {
+		offset, err := strconv.ParseFloat(offsetStr, 32)
+		if err != nil {
+			log.Printf("Invalid CO2_OFFSET value: %q, defaulting to 0.0", offsetStr)
+		} else {
+			c.offset = float32(offset)
+		}
+	}
+	if c.scale == 1 && c.offset == 0 {
+		return nil
+	}
+	log.Printf("CO2 correction enabled: corrected = raw * %g + %g", c.scale, c.offset)
+	return &c
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Daemon owns everything a running process shares between its sensor loops,
+// the HTTP handlers and shutdown: the sink, the read settings and the latest
+// reading. Each sensorLoop keeps its own port and reconnect state.
+type Daemon struct {
+	loops []*sensorLoop
+	sink  Sink
+
+	readCfg        readConfig
+	retries        int
+	loc            *time.Location
+	warm           warmup
+	interval       time.Duration
+	jitter         time.Duration
+	reportInterval time.Duration
+	failOnSelfTest bool
+	// stream reads the frames the sensors send on their own instead of
+	// polling them.
+	stream bool
+	// replay is set when the sensor is replaced by REPLAY_FILE.
+	replay bool
+	// manualReads receives SIGUSR1; it is registered before startup so
+	// the signal can't kill the process in the meantime.
+	manualReads chan os.Signal
+
+	// latest is the most recent successful reading of any sensor.
+	latest latestReading
+	// history holds the recent readings of all sensors for /readings.
+	history *readingHistory
+	// ready guards the one-time systemd readiness notification.
+	ready sync.Once
+}
+
+// runOnce reads and sends once per sensor. The returned error joins the
+// failures of every sensor that did not succeed.
+func (d *Daemon) runOnce(ctx context.Context) error {
+	cmd := buildCommand()
+	var errs []error
+	for _, s := range d.loops {
+		cycle := func() error { return doIt(ctx, d, s, cmd) }
+		if d.stream {
+			cycle = func() error { return streamCycle(ctx, d, s) }
+		}
+		if err := cycle(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// run self-tests each sensor and then reads them all concurrently until ctx
+// is cancelled.
+func (d *Daemon) run(ctx context.Context) {
+	for _, s := range d.loops {
+		// Polling a streaming sensor would only interleave with its
+		// frames.
+		// Neither does the self-test make sense for a replay, where it
+		// would only use up the first recorded frame.
+		if !d.stream && !d.replay {
+			s.runSelfTest(d.readCfg, d.failOnSelfTest)
+		}
+		s.report = newReportWindow(d.reportInterval)
+	}
+
+	go d.watchManualReads(ctx)
+	var wg sync.WaitGroup
+	for _, s := range d.loops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(ctx, d)
+		}()
+	}
+	wg.Wait()
+}
+
+// watchManualReads triggers an immediate read of every sensor on SIGUSR1
+// until ctx is cancelled. A signal received during startup is dropped, as
+// the loops begin with a read anyway.
+func (d *Daemon) watchManualReads(ctx context.Context) {
+	if d.manualReads == nil {
+		return
+	}
+	select {
+	case <-d.manualReads:
+	default:
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.manualReads:
+			slog.Info("received SIGUSR1, requesting a manual read")
+			for _, s := range d.loops {
+				// A read already pending covers this request too.
+				select {
+				case s.trigger <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Close closes the serial ports and then the sink, so buffered writes are
+// flushed last.
+func (d *Daemon) Close() {
+	for _, s := range d.loops {
+		s.port.Close()
+	}
+	if err := d.sink.Close(); err != nil {
+		log.Printf("Error closing output: %v", err)
+	}
+}
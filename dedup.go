@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultDedupMaxGap = 10 * time.Minute
+
+// dedupFilter suppresses writes of readings that match the last written one,
+// reporting by exception. A reading is still written once maxGap has passed
+// since the last write so the series never goes quiet for long.
+type dedupFilter struct {
+	tolerance float32
+	maxGap    time.Duration
+
+	written  bool
+	lastCo2  float32
+	lastTime time.Time
+}
+
+// Skip reports whether result is within tolerance of the last written
+// reading and the last write is more recent than maxGap.
+func (f *dedupFilter) Skip(result *Result) bool {
+	if !f.written {
+		return false
+	}
+	if result.Time.Sub(f.lastTime) >= f.maxGap {
+		return false
+	}
+	return math.Abs(float64(result.Co2Concentration-f.lastCo2)) <= float64(f.tolerance)
+}
+
+// Written records result as the last written reading.
+func (f *dedupFilter) Written(result *Result) {
+	f.written = true
+	f.lastCo2 = result.Co2Concentration
+	f.lastTime = result.Time
+}
+
+// initDedupFilter returns nil unless DEDUP is set. DEDUP_TOLERANCE (ppm,
+// default 0) and DEDUP_MAX_GAP (default 10m) tune it.
+func initDedupFilter() *dedupFilter {
+	enabledStr, found := os.LookupEnv("DEDUP")
+	if !found {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(enabledStr)
+	if err != nil {
+		log.Printf("Invalid DEDUP value: %v, writing every reading", err)
+		return nil
+	}
+	if !enabled {
+		return nil
+	}
+	f := &dedupFilter{maxGap: defaultDedupMaxGap}
+	if toleranceStr, found := os.LookupEnv("DEDUP_TOLERANCE"); found {
+		tolerance, err := strconv.ParseFloat(toleranceStr, 32)
+		if err != nil || tolerance < 0 {
+			log.Printf("Invalid DEDUP_TOLERANCE value: %q, defaulting to 0", toleranceStr)
+		} else {
+			f.tolerance = float32(tolerance)
+		}
+	}
+	if gapStr, found := os.LookupEnv("DEDUP_MAX_GAP"); found {
+		gap, err := time.ParseDuration(gapStr)
+		if err != nil || gap <= 0 {
+			log.Printf("Invalid DEDUP_MAX_GAP value: %q, defaulting to %v", gapStr, defaultDedupMaxGap)
+		} else {
+			f.maxGap = gap
+		}
+	}
+	log.Printf("Duplicate suppression enabled: tolerance %g ppm, writing at least every %v", f.tolerance, f.maxGap)
+	return f
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// initDerivedMetrics reports whether ENABLE_DERIVED_METRICS turns on
+// computeDerived.
+func initDerivedMetrics() bool {
+	enabledStr, found := os.LookupEnv("ENABLE_DERIVED_METRICS")
+	if !found || enabledStr == "" {
+		return false
+	}
+	enabled, err := strconv.ParseBool(enabledStr)
+	if err != nil {
+		log.Printf("Invalid ENABLE_DERIVED_METRICS value: %v, leaving derived metrics disabled", err)
+		return false
+	}
+	return enabled
+}
+
+// computeDerived fills r.Derived with values computed from the measured
+// ones. Every entry is written as a field of the same name, so new
+// derivations need no changes to the sinks.
+//
+// Quantities such as dew point or absolute humidity need a humidity reading,
+// which the MH-Z19C does not provide; until a humidity source is added this
+// only logs the inputs it has.
+func computeDerived(r *Result) {
+	if r.NoTemperature {
+		return
+	}
+	slog.Debug("no humidity source, skipping derived metrics", "temperature", r.Temperature)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+)
+
+const defaultEnvFile = ".env"
+
+// envFileKeys records the variables set from the env file, for
+// settingSource.
+var envFileKeys = map[string]bool{}
+
+// loadEnvFile sets the variables from ENV_FILE, or from ./.env when ENV_FILE
+// is unset and the file exists. Variables already present in the real
+// environment are left alone.
+func loadEnvFile() {
+	path, explicit := os.LookupEnv("ENV_FILE")
+	if !explicit {
+		path = defaultEnvFile
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if explicit || !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error opening ENV_FILE %q: %v, ignoring it", path, err)
+		}
+		return
+	}
+	defer f.Close()
+	vars, err := parseEnvFile(f)
+	if err != nil {
+		log.Printf("Error parsing env file %q: %v, ignoring it", path, err)
+		return
+	}
+	loaded := 0
+	for _, kv := range vars {
+		if _, found := os.LookupEnv(kv[0]); found {
+			continue
+		}
+		if err := os.Setenv(kv[0], kv[1]); err != nil {
+			log.Printf("Error setting %s from env file: %v", kv[0], err)
+			continue
+		}
+		envFileKeys[kv[0]] = true
+		loaded++
+	}
+	log.Printf("Loaded %d variable(s) from env file %q", loaded, path)
+}
+
+// parseEnvFile reads KEY=VALUE lines in file order. Blank lines and lines
+// starting with # are skipped, an optional "export " prefix is accepted, and
+// values may be wrapped in single or double quotes. Unquoted values end at
+// " #"; double-quoted values understand \n, \" and \\.
+func parseEnvFile(r io.Reader) ([][2]string, error) {
+	var vars [][2]string
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: want KEY=VALUE", lineNo)
+		}
+		value, err := envFileValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		vars = append(vars, [2]string{key, value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func envFileValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	switch quote := value[0]; quote {
+	case '\'', '"':
+		end := strings.LastIndexByte(value, quote)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated %c quote", quote)
+		}
+		if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected text after closing quote: %q", rest)
+		}
+		inner := value[1:end]
+		if quote == '"' {
+			inner = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(inner)
+		}
+		return inner, nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	input := `# comment
+UART_DEV=/dev/ttyUSB0
+export INFLUXDB_ORG = home
+INFLUXDB_BUCKET="co2 data" # trailing comment
+INFLUXDB_TOKEN='abc#"def'
+TAGS=room=office # inline
+ESCAPED="line1\nsaid \"hi\""
+EMPTY=
+`
+	vars, err := parseEnvFile(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	want := [][2]string{
+		{"UART_DEV", "/dev/ttyUSB0"},
+		{"INFLUXDB_ORG", "home"},
+		{"INFLUXDB_BUCKET", "co2 data"},
+		{"INFLUXDB_TOKEN", `abc#"def`},
+		{"TAGS", "room=office"},
+		{"ESCAPED", "line1\nsaid \"hi\""},
+		{"EMPTY", ""},
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("parseEnvFile = %q, want %q", vars, want)
+	}
+	for i := range want {
+		if vars[i] != want[i] {
+			t.Errorf("var %d = %q, want %q", i, vars[i], want[i])
+		}
+	}
+}
+
+func TestParseEnvFileErrors(t *testing.T) {
+	for _, input := range []string{"NOEQUALS", "=value", `KEY="unterminated`} {
+		if _, err := parseEnvFile(strings.NewReader(input)); err == nil {
+			t.Errorf("parseEnvFile(%q) returned no error", input)
+		}
+	}
+}
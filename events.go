@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// eventsMeasurement holds the startup and shutdown annotations, kept apart
+// from the readings so dashboards can query them separately.
+const eventsMeasurement = "sensor_events"
+
+// eventShutdownTimeout bounds how long the shutdown event may hold up exit.
+const eventShutdownTimeout = 5 * time.Second
+
+// pointSink is implemented by sinks that can store arbitrary points, which is
+// what the lifecycle events need.
+type pointSink interface {
+	WritePoint(ctx context.Context, points ...*write.Point) error
+}
+
+// initEmitStartupEvent reports whether EMIT_STARTUP_EVENT is set.
+func initEmitStartupEvent() bool {
+	enabledStr, found := os.LookupEnv("EMIT_STARTUP_EVENT")
+	if !found {
+		return false
+	}
+	enabled, err := strconv.ParseBool(enabledStr)
+	if err != nil {
+		log.Printf("Invalid EMIT_STARTUP_EVENT value: %v, disabling lifecycle events", err)
+		return false
+	}
+	return enabled
+}
+
+// emitEvent writes a sensor_events point for event ("startup" or
+// "shutdown") carrying the build version, host and timing settings. tags are
+// the static point tags. Sinks that cannot store points are skipped.
+func (d *Daemon) emitEvent(ctx context.Context, event string, tags map[string]string) {
+	sink, ok := d.sink.(pointSink)
+	if !ok {
+		slog.Warn("output does not support lifecycle events, not writing it", "event", event)
+		return
+	}
+	tags = maps.Clone(tags)
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	tags["event"] = event
+	hostname, _ := os.Hostname()
+	fields := map[string]interface{}{
+		"version":          version,
+		"commit":           commit,
+		"hostname":         hostname,
+		"interval_seconds": d.interval.Seconds(),
+		"timezone":         d.loc.String(),
+	}
+	point := write.NewPoint(eventsMeasurement, tags, fields, time.Now().In(d.loc))
+	if err := sink.WritePoint(ctx, point); err != nil {
+		slog.Error("error writing lifecycle event", "event", event, "error", err)
+		return
+	}
+	slog.Info("wrote lifecycle event", "event", event)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const maxSmoothingWindow = 100
+
+// co2Filter smooths a stream of CO2 readings.
+type co2Filter interface {
+	Add(v float32) float32
+}
+
+const (
+	filterNone   = "none"
+	filterMean   = "mean"
+	filterMedian = "median"
+)
+
+// MovingAverage is a fixed-size ring buffer returning the mean of the most
+// recent window values.
+type MovingAverage struct {
+	values []float32
+	next   int
+	count  int
+	sum    float32
+}
+
+func NewMovingAverage(window int) *MovingAverage {
+	return &MovingAverage{values: make([]float32, window)}
+}
+
+// Add records v and returns the average over the values currently held.
+func (m *MovingAverage) Add(v float32) float32 {
+	if m.count == len(m.values) {
+		m.sum -= m.values[m.next]
+	} else {
+		m.count++
+	}
+	m.values[m.next] = v
+	m.sum += v
+	m.next = (m.next + 1) % len(m.values)
+	return m.sum / float32(m.count)
+}
+
+// initSmoothingWindow returns the SMOOTHING_WINDOW size; 1 disables smoothing.
+func initSmoothingWindow() int {
+	windowStr, found := os.LookupEnv("SMOOTHING_WINDOW")
+	if !found {
+		return 1
+	}
+	window, err := strconv.Atoi(windowStr)
+	if err != nil {
+		log.Printf("Invalid SMOOTHING_WINDOW value: %v, disabling smoothing", err)
+		return 1
+	}
+	if window < 1 {
+		log.Printf("SMOOTHING_WINDOW must be at least 1, disabling smoothing")
+		return 1
+	}
+	if window > maxSmoothingWindow {
+		log.Printf("SMOOTHING_WINDOW too large, capping at %d", maxSmoothingWindow)
+		return maxSmoothingWindow
+	}
+	return window
+}
+
+// MedianFilter returns the median of the most recent window values, which
+// unlike a mean is not dragged by a single outlier. It keeps the values both
+// in arrival order, to know which one to evict, and in a sorted slice.
+type MedianFilter struct {
+	values []float32
+	sorted []float32
+	next   int
+	count  int
+}
+
+func NewMedianFilter(window int) *MedianFilter {
+	return &MedianFilter{
+		values: make([]float32, window),
+		sorted: make([]float32, 0, window),
+	}
+}
+
+// Add records v and returns the median of the values currently held.
+func (m *MedianFilter) Add(v float32) float32 {
+	if m.count == len(m.values) {
+		oldest := m.values[m.next]
+		i, _ := slices.BinarySearch(m.sorted, oldest)
+		m.sorted = slices.Delete(m.sorted, i, i+1)
+	} else {
+		m.count++
+	}
+	m.values[m.next] = v
+	m.next = (m.next + 1) % len(m.values)
+	i, _ := slices.BinarySearch(m.sorted, v)
+	m.sorted = slices.Insert(m.sorted, i, v)
+
+	mid := len(m.sorted) / 2
+	if len(m.sorted)%2 == 0 {
+		return (m.sorted[mid-1] + m.sorted[mid]) / 2
+	}
+	return m.sorted[mid]
+}
+
+// initFilterType returns FILTER_TYPE. When unset, a SMOOTHING_WINDOW above 1
+// keeps selecting the moving average as before.
+func initFilterType(window int) string {
+	filterType, found := os.LookupEnv("FILTER_TYPE")
+	if !found || filterType == "" {
+		if window > 1 {
+			return filterMean
+		}
+		return filterNone
+	}
+	switch filterType {
+	case filterNone, filterMean, filterMedian:
+		return filterType
+	default:
+		log.Printf("Invalid FILTER_TYPE value: %q, expected none, mean or median; disabling filtering", filterType)
+		return filterNone
+	}
+}
+
+// initFilter returns nil when filtering is disabled.
+func initFilter() co2Filter {
+	window := initSmoothingWindow()
+	switch initFilterType(window) {
+	case filterMean:
+		if window == 1 {
+			return nil
+		}
+		log.Printf("Smoothing CO2 over a moving average of %d readings", window)
+		return NewMovingAverage(window)
+	case filterMedian:
+		if window%2 == 0 {
+			window++
+			log.Printf("Median filter window must be odd, using %d", window)
+		}
+		if window == 1 {
+			return nil
+		}
+		log.Printf("Filtering CO2 with a median of %d readings", window)
+		return NewMedianFilter(window)
+	default:
+		return nil
+	}
+}
+
+const defaultStepRejects = 3
+
+// stepFilter rejects readings that jump further from the last accepted one
+// than maxStep allows. The allowance grows with the time since that reading,
+// in units of interval, so a gap after failed reads isn't mistaken for a
+// glitch. After maxRejects consecutive rejections the new level is accepted,
+// since by then the change is real.
+type stepFilter struct {
+	maxStep    float32
+	maxRejects int
+	interval   time.Duration
+
+	accepted bool
+	last     float32
+	lastTime time.Time
+	rejects  int
+}
+
+// Accept reports whether co2, read at t, is plausible given the last
+// accepted reading, and records it if so.
+func (f *stepFilter) Accept(co2 float32, t time.Time) bool {
+	if f.accepted && f.rejects < f.maxRejects {
+		allowed := f.maxStep
+		if f.interval > 0 {
+			if steps := float32(t.Sub(f.lastTime)) / float32(f.interval); steps > 1 {
+				allowed *= steps
+			}
+		}
+		if diff := co2 - f.last; diff > allowed || diff < -allowed {
+			f.rejects++
+			return false
+		}
+	}
+	f.accepted = true
+	f.last = co2
+	f.lastTime = t
+	f.rejects = 0
+	return true
+}
+
+// initStepFilter returns nil unless MAX_CO2_STEP_PPM is set.
+// MAX_CO2_STEP_REJECTS (default 3) is how many readings in a row may be
+// rejected before the new level is accepted.
+func initStepFilter() *stepFilter {
+	stepStr, found := os.LookupEnv("MAX_CO2_STEP_PPM")
+	if !found || stepStr == "" {
+		return nil
+	}
+	step, err := strconv.ParseFloat(stepStr, 32)
+	if err != nil || step <= 0 {
+		log.Printf("Invalid MAX_CO2_STEP_PPM value: %q, disabling the step filter", stepStr)
+		return nil
+	}
+	f := &stepFilter{maxStep: float32(step), maxRejects: defaultStepRejects}
+	if rejectsStr, found := os.LookupEnv("MAX_CO2_STEP_REJECTS"); found {
+		rejects, err := strconv.Atoi(rejectsStr)
+		if err != nil || rejects < 1 {
+			log.Printf("Invalid MAX_CO2_STEP_REJECTS value: %q, defaulting to %d", rejectsStr, defaultStepRejects)
+		} else {
+			f.maxRejects = rejects
+		}
+	}
+	log.Printf("Rejecting CO2 steps above %g ppm per reading, accepting a new level after %d rejections", f.maxStep, f.maxRejects)
+	return f
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMovingAverage(t *testing.T) {
+	m := NewMovingAverage(3)
+	for i, tc := range []struct {
+		in, want float32
+	}{
+		{600, 600},
+		{900, 750},
+		{600, 700},
+		{1200, 900},
+	} {
+		if got := m.Add(tc.in); got != tc.want {
+			t.Errorf("Add #%d(%v) = %v, want %v", i, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMedianFilterRejectsSpike(t *testing.T) {
+	m := NewMedianFilter(3)
+	for i, tc := range []struct {
+		in, want float32
+	}{
+		{600, 600},
+		{5000, 2800},
+		{610, 610},
+		{620, 620},
+		{630, 620},
+	} {
+		if got := m.Add(tc.in); got != tc.want {
+			t.Errorf("Add #%d(%v) = %v, want %v", i, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDedupFilter(t *testing.T) {
+	f := &dedupFilter{tolerance: 5, maxGap: time.Minute}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		co2    float32
+		offset time.Duration
+		skip   bool
+	}{
+		{800, 0, false},
+		{804, 10 * time.Second, true},
+		{806, 20 * time.Second, false},
+		{806, 30 * time.Second, true},
+		{806, 80 * time.Second, false},
+	}
+	for i, step := range steps {
+		result := &Result{Co2Concentration: step.co2, Time: start.Add(step.offset)}
+		if got := f.Skip(result); got != step.skip {
+			t.Errorf("step %d: Skip = %v, want %v", i, got, step.skip)
+		}
+		if !step.skip {
+			f.Written(result)
+		}
+	}
+}
+
+func TestStepFilter(t *testing.T) {
+	f := &stepFilter{maxStep: 200, maxRejects: 2, interval: time.Minute}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, step := range []struct {
+		co2     float32
+		minutes int
+		want    bool
+	}{
+		{500, 0, true},
+		{4000, 1, false}, // glitch
+		{650, 2, true},
+		{1000, 4, true}, // 350 ppm over two intervals is within 2*200
+		{3000, 5, false},
+		{3000, 6, false},
+		{3000, 7, true}, // accepted after maxRejects rejections
+	} {
+		if got := f.Accept(step.co2, start.Add(time.Duration(step.minutes)*time.Minute)); got != step.want {
+			t.Errorf("step %d: Accept(%v) = %v, want %v", i, step.co2, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latestReading holds the most recent successful reading for HTTP handlers.
+type latestReading struct {
+	mu        sync.Mutex
+	result    Result
+	timestamp time.Time
+	ok        bool
+}
+
+func (l *latestReading) Set(result Result, timestamp time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.result = result
+	l.timestamp = timestamp
+	l.ok = true
+}
+
+// Get returns the latest reading; ok is false until the first success.
+func (l *latestReading) Get() (result Result, timestamp time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.result, l.timestamp, l.ok
+}
+
+const defaultHistorySize = 60
+
+// historyEntry is one reading as served by /readings.
+type historyEntry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Co2         float32   `json:"co2"`
+	Temperature *float32  `json:"temperature,omitempty"`
+	SensorID    string    `json:"sensor_id,omitempty"`
+}
+
+// readingHistory is a ring buffer of the most recent readings.
+type readingHistory struct {
+	mu      sync.Mutex
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+func newReadingHistory(size int) *readingHistory {
+	return &readingHistory{entries: make([]historyEntry, size)}
+}
+
+// Add records result, replacing the oldest entry once the buffer is full.
+func (h *readingHistory) Add(result *Result) {
+	if len(h.entries) == 0 {
+		return
+	}
+	entry := historyEntry{
+		Timestamp: result.Time,
+		Co2:       result.Co2Concentration,
+		SensorID:  result.Tags["sensor_id"],
+	}
+	if !result.NoTemperature {
+		temperature := result.Temperature
+		entry.Temperature = &temperature
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Entries returns the held readings, oldest first.
+func (h *readingHistory) Entries() []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]historyEntry{}, h.entries[:h.next]...)
+	}
+	return append(append([]historyEntry{}, h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+// initHistorySize returns HISTORY_SIZE, the number of readings kept for
+// /readings; 0 disables the history.
+func initHistorySize() int {
+	sizeStr, found := os.LookupEnv("HISTORY_SIZE")
+	if !found {
+		return defaultHistorySize
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 0 {
+		log.Printf("Invalid HISTORY_SIZE value: %q, defaulting to %d", sizeStr, defaultHistorySize)
+		return defaultHistorySize
+	}
+	return size
+}
+
+// readingsHandler serves the reading history as a JSON array, oldest first.
+func readingsHandler(history *readingHistory) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, history.Entries())
+	}
+}
+
+type co2Response struct {
+	Co2         float32   `json:"co2"`
+	Temperature *float32  `json:"temperature,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("error encoding HTTP response", "error", err)
+	}
+}
+
+// co2Handler serves the latest reading as JSON.
+func co2Handler(latest *latestReading) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		result, timestamp, ok := latest.Get()
+		if !ok {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no successful reading yet"})
+			return
+		}
+		resp := co2Response{Co2: result.Co2Concentration, Timestamp: timestamp}
+		if !result.NoTemperature {
+			resp.Temperature = &result.Temperature
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+type healthResponse struct {
+	Status        string     `json:"status"`
+	LastReading   *time.Time `json:"last_reading,omitempty"`
+	AgeSeconds    float64    `json:"age_seconds,omitempty"`
+	MaxAgeSeconds float64    `json:"max_age_seconds"`
+	// ReadsTotal and LastReadUnixtime cover failed cycles too.
+	ReadsTotal       uint64 `json:"reads_total"`
+	LastReadUnixtime int64  `json:"last_read_unixtime,omitempty"`
+}
+
+// healthzHandler reports healthy only if a reading succeeded within maxAge.
+func healthzHandler(latest *latestReading, maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		_, timestamp, ok := latest.Get()
+		resp := healthResponse{
+			MaxAgeSeconds:    maxAge.Seconds(),
+			ReadsTotal:       heartbeat.reads.Load(),
+			LastReadUnixtime: heartbeat.lastRead.Load(),
+		}
+		if !ok {
+			resp.Status = "no successful reading yet"
+			writeJSON(w, http.StatusServiceUnavailable, resp)
+			return
+		}
+		age := time.Since(timestamp)
+		resp.LastReading = &timestamp
+		resp.AgeSeconds = age.Seconds()
+		if age > maxAge {
+			resp.Status = "stale"
+			writeJSON(w, http.StatusServiceUnavailable, resp)
+			return
+		}
+		resp.Status = "ok"
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+type statusResponse struct {
+	WarmingUp              bool      `json:"warming_up"`
+	WarmupRemainingSeconds float64   `json:"warmup_remaining_seconds"`
+	UptimeSeconds          float64   `json:"uptime_seconds"`
+	StartTime              time.Time `json:"start_time"`
+}
+
+// statusHandler reports whether readings are still held back by the warm-up,
+// measured from the process start recorded in warm.
+func statusHandler(warm warmup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		now := time.Now()
+		resp := statusResponse{
+			WarmingUp:     warm.active(now),
+			UptimeSeconds: now.Sub(warm.start).Seconds(),
+			StartTime:     warm.start,
+		}
+		if resp.WarmingUp {
+			resp.WarmupRemainingSeconds = warm.remaining(now).Seconds()
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// initHealthMaxAge returns HEALTH_MAX_AGE, defaulting to twice the interval
+// between reads.
+func initHealthMaxAge(sleepDuration time.Duration) time.Duration {
+	defaultMaxAge := 2 * sleepDuration
+	ageStr, found := os.LookupEnv("HEALTH_MAX_AGE")
+	if !found {
+		return defaultMaxAge
+	}
+	seconds, err := strconv.Atoi(ageStr)
+	if err != nil {
+		log.Printf("Invalid HEALTH_MAX_AGE value: %v, defaulting to %v", err, defaultMaxAge)
+		return defaultMaxAge
+	}
+	if seconds <= 0 {
+		log.Printf("HEALTH_MAX_AGE must be positive, defaulting to %v", defaultMaxAge)
+		return defaultMaxAge
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func initHTTPAddr() string {
+	addr, found := os.LookupEnv("HTTP_ADDR")
+	if !found {
+		addr = ":8080"
+	}
+	return addr
+}
+
+func startHTTPServer(addr string, enablePrometheus bool, healthMaxAge time.Duration, d *Daemon, admin *calibrationAdmin) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/co2", co2Handler(&d.latest))
+	mux.HandleFunc("/healthz", healthzHandler(&d.latest, healthMaxAge))
+	mux.HandleFunc("/status", statusHandler(d.warm))
+	mux.HandleFunc("/readings", readingsHandler(d.history))
+	admin.routes(mux)
+	mux.HandleFunc("/debug/frame", admin.debugFrameHandler(&d.latest))
+	if enablePrometheus {
+		mux.Handle("/metrics", metricsHandler())
+		log.Printf("Prometheus metrics enabled on /metrics")
+	}
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Printf("HTTP server listening on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server error", "error", err)
+		}
+	}()
+	return srv
+}
+
+const httpShutdownTimeout = 5 * time.Second
+
+func shutdownHTTPServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down HTTP server", "error", err)
+	}
+}
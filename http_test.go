@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthzHandler(t *testing.T) {
+	var latest latestReading
+	handler := healthzHandler(&latest, time.Minute)
+	serve := func(method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, "/healthz", nil))
+		return rec
+	}
+
+	if rec := serve(http.MethodPost); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodGet {
+		t.Errorf("POST /healthz = %d, Allow %q; want %d, Allow GET", rec.Code, rec.Header().Get("Allow"), http.StatusMethodNotAllowed)
+	}
+	if rec := serve(http.MethodGet); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /healthz before any reading = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	latest.Set(Result{Co2Concentration: 650}, time.Now().Add(-2*time.Minute))
+	if rec := serve(http.MethodGet); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /healthz with a stale reading = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	latest.Set(Result{Co2Concentration: 650}, time.Now())
+	if rec := serve(http.MethodGet); rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz with a fresh reading = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestDebugFrameHandlerShowsRejectedFrame(t *testing.T) {
+	rawFrames = rawFrameRecorder{}
+	bad := frame(812, 24)
+	bad[8]++
+	if _, err := read(&fakeSerial{response: bad}, buildCommand(), testReadConfig); err == nil {
+		t.Fatal("read of a bad checksum succeeded")
+	}
+
+	admin := &calibrationAdmin{token: "secret"}
+	req := httptest.NewRequest(http.MethodGet, "/debug/frame", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	admin.debugFrameHandler(&latestReading{})(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /debug/frame = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var resp struct {
+		Frame      string           `json:"frame"`
+		ChecksumOK bool             `json:"checksum_ok"`
+		Error      string           `json:"error"`
+		Reading    *json.RawMessage `json:"reading"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body, err)
+	}
+	if resp.Frame != fmt.Sprintf("% x", bad) || resp.ChecksumOK || !strings.Contains(resp.Error, "invalid checksum") {
+		t.Errorf("response = %+v, want the bad frame with its checksum error", resp)
+	}
+	if resp.Reading != nil {
+		t.Errorf("reading = %s, want none without an accepted reading", *resp.Reading)
+	}
+}
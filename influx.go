@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// pointWriter is the subset of the InfluxDB write APIs used by send. It is
+// satisfied directly by api.WriteAPIBlocking and by asyncWriter.
+type pointWriter interface {
+	WritePoint(ctx context.Context, point ...*write.Point) error
+	WriteRecord(ctx context.Context, line ...string) error
+}
+
+// asyncWriter adapts the non-blocking api.WriteAPI to pointWriter. Points are
+// queued into the client's batch buffer; write failures are reported on the
+// API's error channel rather than returned, and fed into health from there.
+type asyncWriter struct {
+	api    api.WriteAPI
+	health *writeHealth
+	// ping checks the server before queueing again after a failure, since
+	// the client never reports a batch that succeeded.
+	ping func(ctx context.Context) error
+}
+
+func (w asyncWriter) WritePoint(ctx context.Context, point ...*write.Point) error {
+	if err := w.ready(ctx); err != nil {
+		return err
+	}
+	for _, p := range point {
+		w.api.WritePoint(p)
+	}
+	return nil
+}
+
+func (w asyncWriter) WriteRecord(ctx context.Context, line ...string) error {
+	if err := w.ready(ctx); err != nil {
+		return err
+	}
+	for _, l := range line {
+		w.api.WriteRecord(l)
+	}
+	return nil
+}
+
+// ready refuses writes during the backoff and, once it has passed, pings the
+// server before resuming.
+func (w asyncWriter) ready(ctx context.Context) error {
+	if w.health.suspended() {
+		return errWritesSuspended
+	}
+	if !w.health.failing() {
+		return nil
+	}
+	if err := w.ping(ctx); err != nil {
+		w.health.failure(err)
+		return fmt.Errorf("%w: %v", errWritesSuspended, err)
+	}
+	w.health.success()
+	return nil
+}
+
+const (
+	writeBaseBackoff = 5 * time.Second
+	writeMaxBackoff  = 5 * time.Minute
+)
+
+// errWritesSuspended marks writes that failed or were skipped while
+// InfluxDB is considered unhealthy. The transition is logged once by
+// writeHealth, so callers need not log these individually.
+var errWritesSuspended = errors.New("InfluxDB writes suspended")
+
+// writeHealth tracks consecutive write failures to one target. After a
+// failure, writes are skipped for an exponentially growing delay up to
+// writeMaxBackoff; the first success resets it. Readings taken meanwhile are
+// kept by the disk buffer, when enabled. Only the transitions between healthy
+// and unhealthy are logged.
+type writeHealth struct {
+	target string
+
+	mu          sync.Mutex
+	failures    int
+	nextAttempt time.Time
+}
+
+func (h *writeHealth) suspended() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().Before(h.nextAttempt)
+}
+
+func (h *writeHealth) failing() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures > 0
+}
+
+func (h *writeHealth) failure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	delay := writeMaxBackoff
+	if shift := h.failures - 1; shift < 16 {
+		delay = min(writeBaseBackoff<<shift, writeMaxBackoff)
+	}
+	h.nextAttempt = time.Now().Add(delay)
+	if h.failures == 1 {
+		slog.Error("InfluxDB unhealthy, backing off writes", "target", h.target, "error", err)
+	}
+	slog.Debug("write failed, backing off", "target", h.target, "failures", h.failures, "retry_in", delay, "error", err)
+}
+
+func (h *writeHealth) success() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failures > 0 {
+		slog.Info("InfluxDB healthy again, resuming writes", "target", h.target, "failed_attempts", h.failures)
+	}
+	h.failures = 0
+	h.nextAttempt = time.Time{}
+}
+
+// backoffWriter applies writeHealth to blocking writes, which report their
+// outcome directly.
+type backoffWriter struct {
+	next   pointWriter
+	health *writeHealth
+}
+
+func (w *backoffWriter) WritePoint(ctx context.Context, point ...*write.Point) error {
+	return w.attempt(func() error { return w.next.WritePoint(ctx, point...) })
+}
+
+func (w *backoffWriter) WriteRecord(ctx context.Context, line ...string) error {
+	return w.attempt(func() error { return w.next.WriteRecord(ctx, line...) })
+}
+
+func (w *backoffWriter) attempt(write func() error) error {
+	if w.health.suspended() {
+		return errWritesSuspended
+	}
+	if err := write(); err != nil {
+		w.health.failure(err)
+		return fmt.Errorf("%w: %v", errWritesSuspended, err)
+	}
+	w.health.success()
+	return nil
+}
+
+// influxTarget is one org/bucket pair that every point is written to.
+type influxTarget struct {
+	Org    string
+	Bucket string
+}
+
+func (t influxTarget) String() string {
+	if t.Org == "" {
+		return t.Bucket
+	}
+	return t.Org + "/" + t.Bucket
+}
+
+// parseTargets pairs the comma-separated orgs and buckets. A single org
+// applies to every bucket; otherwise both lists must have the same length.
+func parseTargets(orgs, buckets string) ([]influxTarget, error) {
+	bucketList := splitList(buckets)
+	orgList := splitList(orgs)
+	if len(bucketList) == 0 {
+		return nil, fmt.Errorf("INFLUXDB_BUCKET is empty")
+	}
+	if len(orgList) > 1 && len(orgList) != len(bucketList) {
+		return nil, fmt.Errorf("INFLUXDB_ORG lists %d orgs for %d buckets; give one org or one per bucket", len(orgList), len(bucketList))
+	}
+	targets := make([]influxTarget, len(bucketList))
+	for i, bucket := range bucketList {
+		targets[i].Bucket = bucket
+		switch len(orgList) {
+		case 0:
+		case 1:
+			targets[i].Org = orgList[0]
+		default:
+			targets[i].Org = orgList[i]
+		}
+	}
+	return targets, nil
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// multiWriter fans every write out to all targets. Each target is tried even
+// if another fails, and the failures are joined into one error.
+type multiWriter []pointWriter
+
+func (m multiWriter) WritePoint(ctx context.Context, point ...*write.Point) error {
+	var errs []error
+	for _, w := range m {
+		if err := w.WritePoint(ctx, point...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiWriter) WriteRecord(ctx context.Context, line ...string) error {
+	var errs []error
+	for _, w := range m {
+		if err := w.WriteRecord(ctx, line...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// targetWriter wraps a writer with the name of its target in errors.
+type targetWriter struct {
+	target influxTarget
+	next   pointWriter
+}
+
+func (w targetWriter) WritePoint(ctx context.Context, point ...*write.Point) error {
+	if err := w.next.WritePoint(ctx, point...); err != nil {
+		return fmt.Errorf("%s: %w", w.target, err)
+	}
+	return nil
+}
+
+func (w targetWriter) WriteRecord(ctx context.Context, line ...string) error {
+	if err := w.next.WriteRecord(ctx, line...); err != nil {
+		return fmt.Errorf("%s: %w", w.target, err)
+	}
+	return nil
+}
+
+// newPointWriter returns the write path for info, fanning out to every
+// target. When buffer is non-nil, failed writes are spooled to disk:
+// synchronously for blocking writes, and from the failed-batch callback for
+// async writes. A point that fails on any target is replayed to all of them;
+// InfluxDB overwrites the duplicates on the healthy ones.
+func newPointWriter(client influxdb2.Client, info InfluxDBInfo, blocking bool, buffer *diskBuffer) pointWriter {
+	var writer pointWriter
+	if len(info.Targets) == 1 {
+		writer = newTargetWriter(client, info.Targets[0], blocking, buffer)
+	} else {
+		targets := make(multiWriter, len(info.Targets))
+		for i, target := range info.Targets {
+			targets[i] = targetWriter{target: target, next: newTargetWriter(client, target, blocking, buffer)}
+		}
+		writer = targets
+	}
+	if buffer == nil {
+		return writer
+	}
+	return &bufferedWriter{next: writer, buffer: buffer, precision: client.Options().Precision()}
+}
+
+func newTargetWriter(client influxdb2.Client, target influxTarget, blocking bool, buffer *diskBuffer) pointWriter {
+	health := &writeHealth{target: target.String()}
+	if blocking {
+		// Blocking writes report their outcome directly.
+		return &backoffWriter{next: client.WriteAPIBlocking(target.Org, target.Bucket), health: health}
+	}
+	writeAPI := client.WriteAPI(target.Org, target.Bucket)
+	errorsCh := writeAPI.Errors()
+	go func() {
+		// A batch handed to the failed-write callback below is reported
+		// here too, so this covers every failure once.
+		for err := range errorsCh {
+			health.failure(err)
+			influxWriteFailuresTotal.Inc()
+		}
+	}()
+	if buffer != nil {
+		writeAPI.SetWriteFailedCallback(func(batch string, err http.Error, _ uint) bool {
+			lines := strings.Split(strings.TrimSuffix(batch, "\n"), "\n")
+			if err := buffer.Append(lines...); err != nil {
+				slog.Error("error buffering failed batch to disk, data lost", "error", err)
+			} else {
+				slog.Debug("buffered failed batch", "lines", len(lines), "path", buffer.path)
+			}
+			// The batch is now on disk; don't let the client retry it too.
+			return false
+		})
+	}
+	ping := func(ctx context.Context) error {
+		_, err := client.Ping(ctx)
+		return err
+	}
+	return asyncWriter{api: writeAPI, health: health, ping: ping}
+}
+
+const (
+	defaultInfluxStartupRetries = 3
+	influxProbeTimeout          = 5 * time.Second
+	influxStartupBaseBackoff    = 1 * time.Second
+	influxStartupMaxBackoff     = 30 * time.Second
+)
+
+// initInfluxStartupRetries returns INFLUXDB_STARTUP_RETRIES, the number of
+// extra attempts made to reach InfluxDB at startup. A negative value skips
+// the check.
+func initInfluxStartupRetries() int {
+	retriesStr, found := os.LookupEnv("INFLUXDB_STARTUP_RETRIES")
+	if !found {
+		return defaultInfluxStartupRetries
+	}
+	retries, err := strconv.Atoi(retriesStr)
+	if err != nil {
+		log.Printf("Invalid INFLUXDB_STARTUP_RETRIES value: %v, defaulting to %d", err, defaultInfluxStartupRetries)
+		return defaultInfluxStartupRetries
+	}
+	return retries
+}
+
+// probeInflux checks that the server answers, retrying with exponential
+// backoff, and for 2.x servers that the token is accepted. Misconfiguration
+// then shows up as a startup error instead of failing writes later.
+func probeInflux(client influxdb2.Client, info InfluxDBInfo, retries int) error {
+	if retries < 0 {
+		return nil
+	}
+	backoff := influxStartupBaseBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), influxProbeTimeout)
+		_, err := client.Ping(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+		if attempt >= retries {
+			return fmt.Errorf("InfluxDB at %s is unreachable after %d attempt(s): %v", info.URL, attempt+1, err)
+		}
+		slog.Warn("InfluxDB not reachable, retrying", "url", info.URL, "attempt", attempt+1, "retry_in", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, influxStartupMaxBackoff)
+	}
+	if info.Version == 1 {
+		// The 1.x compatibility API has no endpoint to check credentials
+		// without writing.
+		log.Printf("InfluxDB at %s is reachable", info.URL)
+		return nil
+	}
+	for _, target := range info.Targets {
+		ctx, cancel := context.WithTimeout(context.Background(), influxProbeTimeout)
+		_, err := client.BucketsAPI().FindBucketByName(ctx, target.Bucket)
+		cancel()
+		if isUnauthorized(err) {
+			return fmt.Errorf("InfluxDB at %s rejected the token; check INFLUXDB_TOKEN or INFLUXDB_TOKEN_FILE: %v", info.URL, err)
+		}
+		if err != nil {
+			// Write-only tokens may not be allowed to look buckets up.
+			slog.Warn("could not verify InfluxDB bucket", "target", target.String(), "error", err)
+		}
+	}
+	log.Printf("InfluxDB at %s is reachable", info.URL)
+	return nil
+}
+
+// isUnauthorized reports whether err is a 401 from the InfluxDB API. The
+// generated client only returns the message, formatted as "code: message"
+// for JSON errors or as the HTTP status otherwise.
+func isUnauthorized(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, string(domain.ErrorCodeUnauthorized)+":") || strings.HasPrefix(msg, "401 ")
+}
+
+// initServerTimestamp reports whether INFLUXDB_SERVER_TIMESTAMP asks for
+// points without a timestamp, so the server stamps them on receipt and a
+// skewed device clock cannot corrupt the series.
+func initServerTimestamp() bool {
+	serverStr, found := os.LookupEnv("INFLUXDB_SERVER_TIMESTAMP")
+	if !found || serverStr == "" {
+		return false
+	}
+	server, err := strconv.ParseBool(serverStr)
+	if err != nil {
+		log.Printf("Invalid INFLUXDB_SERVER_TIMESTAMP value: %v, keeping client-side timestamps", err)
+		return false
+	}
+	return server
+}
+
+func initBlockingWrites() bool {
+	blockingStr, found := os.LookupEnv("INFLUXDB_BLOCKING_WRITES")
+	if !found {
+		return false
+	}
+	blocking, err := strconv.ParseBool(blockingStr)
+	if err != nil {
+		log.Printf("Invalid INFLUXDB_BLOCKING_WRITES value: %v, defaulting to batched writes", err)
+		return false
+	}
+	return blocking
+}
+
+const defaultWriteTimeout = 10 * time.Second
+
+// initWriteTimeout returns INFLUXDB_WRITE_TIMEOUT, the longest a single write
+// may take before it counts as failed.
+func initWriteTimeout() time.Duration {
+	timeoutStr, found := os.LookupEnv("INFLUXDB_WRITE_TIMEOUT")
+	if !found || timeoutStr == "" {
+		return defaultWriteTimeout
+	}
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil || timeout <= 0 {
+		log.Printf("Invalid INFLUXDB_WRITE_TIMEOUT value: %q, defaulting to %v", timeoutStr, defaultWriteTimeout)
+		return defaultWriteTimeout
+	}
+	return timeout
+}
+
+const defaultBatchSize = 10
+
+func initBatchSize() uint {
+	batchStr, found := os.LookupEnv("INFLUXDB_BATCH_SIZE")
+	if !found {
+		return defaultBatchSize
+	}
+	batch, err := strconv.Atoi(batchStr)
+	if err != nil {
+		log.Printf("Invalid INFLUXDB_BATCH_SIZE value: %v, defaulting to %d", err, defaultBatchSize)
+		return defaultBatchSize
+	}
+	if batch <= 0 {
+		log.Printf("INFLUXDB_BATCH_SIZE must be positive, defaulting to %d", defaultBatchSize)
+		return defaultBatchSize
+	}
+	return uint(batch)
+}
+
+// clientOptions configures batching for the async write API. Batches are
+// flushed once batchSize points have accumulated, or after the client's
+// default flush interval so a partial batch is not held indefinitely.
+func clientOptions(batchSize uint, precision time.Duration, gzip bool) *influxdb2.Options {
+	return influxdb2.DefaultOptions().
+		SetBatchSize(batchSize).
+		SetPrecision(precision).
+		SetUseGZip(gzip)
+}
+
+// initTLSConfig returns the TLS settings for self-signed servers, or nil to
+// keep the default verification against the system roots.
+func initTLSConfig() (*tls.Config, error) {
+	skipVerify := false
+	if skipStr, found := os.LookupEnv("INFLUXDB_TLS_SKIP_VERIFY"); found && skipStr != "" {
+		var err error
+		skipVerify, err = strconv.ParseBool(skipStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid INFLUXDB_TLS_SKIP_VERIFY value: %v", err)
+		}
+	}
+	caFile := os.Getenv("INFLUXDB_CA_FILE")
+	if !skipVerify && caFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+	if skipVerify {
+		log.Printf("WARNING: INFLUXDB_TLS_SKIP_VERIFY is set, the InfluxDB certificate will not be verified")
+		cfg.InsecureSkipVerify = true
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read INFLUXDB_CA_FILE %s: %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("INFLUXDB_CA_FILE %s contains no PEM certificates", caFile)
+		}
+		cfg.RootCAs = pool
+		log.Printf("Trusting InfluxDB CA certificates from %s", caFile)
+	}
+	return cfg, nil
+}
+
+// initGzip reports whether INFLUXDB_GZIP enables request compression. It
+// applies to blocking writes and to the batches sent by async writes alike.
+func initGzip() bool {
+	gzipStr, found := lookupEnv("INFLUXDB_GZIP")
+	if !found || gzipStr == "" {
+		return false
+	}
+	gzip, err := strconv.ParseBool(gzipStr)
+	if err != nil {
+		log.Printf("Invalid INFLUXDB_GZIP value: %v, leaving compression off", err)
+		return false
+	}
+	return gzip
+}
+
+// precisions maps INFLUXDB_PRECISION values to write precisions.
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+func initPrecision() (time.Duration, error) {
+	precisionStr, found := os.LookupEnv("INFLUXDB_PRECISION")
+	if !found || precisionStr == "" {
+		return time.Nanosecond, nil
+	}
+	precision, ok := precisions[precisionStr]
+	if !ok {
+		return 0, fmt.Errorf("invalid INFLUXDB_PRECISION value: %q, expected ns, us, ms or s", precisionStr)
+	}
+	return precision, nil
+}
+
+func initInfluxVersion() int {
+	versionStr, found := os.LookupEnv("INFLUXDB_VERSION")
+	if !found {
+		return 2
+	}
+	switch versionStr {
+	case "1":
+		return 1
+	case "2":
+		return 2
+	default:
+		log.Printf("Invalid INFLUXDB_VERSION value: %q, defaulting to 2", versionStr)
+		return 2
+	}
+}
+
+// initV1Bucket maps an InfluxDB 1.x database and optional retention policy to
+// the "database/retention-policy" bucket name used by the v2 compatibility API.
+func initV1Bucket() (string, error) {
+	database := strings.TrimSpace(os.Getenv("INFLUXDB_DATABASE"))
+	if database == "" {
+		return "", fmt.Errorf("INFLUXDB_DATABASE not set (required when INFLUXDB_VERSION=1; it replaces INFLUXDB_BUCKET as database[/INFLUXDB_RETENTION_POLICY])")
+	}
+	if rp := strings.TrimSpace(os.Getenv("INFLUXDB_RETENTION_POLICY")); rp != "" {
+		return database + "/" + rp, nil
+	}
+	return database, nil
+}
+
+// initV1Token maps InfluxDB 1.x credentials to the "username:password" token
+// used by the v2 compatibility API. Servers without auth accept an empty token.
+func initV1Token() (string, error) {
+	username := os.Getenv("INFLUXDB_USERNAME")
+	password := os.Getenv("INFLUXDB_PASSWORD")
+	if username == "" && password == "" {
+		return "", nil
+	}
+	if username == "" {
+		return "", fmt.Errorf("INFLUXDB_USERNAME not set (required with INFLUXDB_PASSWORD when INFLUXDB_VERSION=1; sent as token username:password)")
+	}
+	if password == "" {
+		return "", fmt.Errorf("INFLUXDB_PASSWORD not set (required with INFLUXDB_USERNAME when INFLUXDB_VERSION=1; sent as token username:password)")
+	}
+	return username + ":" + password, nil
+}
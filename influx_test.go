@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAsyncWriterBacksOff(t *testing.T) {
+	health := &writeHealth{target: "test"}
+	pingErr := errors.New("connection refused")
+	pings := 0
+	w := asyncWriter{health: health, ping: func(context.Context) error {
+		pings++
+		return pingErr
+	}}
+	ctx := context.Background()
+
+	if err := w.ready(ctx); err != nil {
+		t.Fatalf("ready while healthy = %v, want nil", err)
+	}
+	// A failed batch arrives on the client's error channel.
+	health.failure(errors.New("batch failed"))
+	if err := w.ready(ctx); !errors.Is(err, errWritesSuspended) || pings != 0 {
+		t.Errorf("ready during backoff = %v after %d ping(s), want errWritesSuspended without pinging", err, pings)
+	}
+
+	health.nextAttempt = time.Now()
+	if err := w.ready(ctx); !errors.Is(err, errWritesSuspended) || pings != 1 {
+		t.Errorf("ready with server still down = %v after %d ping(s), want errWritesSuspended after 1", err, pings)
+	}
+	if health.failures != 2 || !health.suspended() {
+		t.Errorf("failures = %d, suspended = %v; want 2, true", health.failures, health.suspended())
+	}
+
+	health.nextAttempt = time.Now()
+	pingErr = nil
+	if err := w.ready(ctx); err != nil {
+		t.Errorf("ready after recovery = %v, want nil", err)
+	}
+	if health.failing() {
+		t.Error("still failing after a successful ping")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// initLogger configures the default slog logger from LOG_FORMAT (text or
+// json) and LOG_LEVEL (debug, info, warn or error). Setting the default slog
+// logger also routes the standard log package through it, so unstructured
+// log.Printf calls are emitted at info level in the chosen format.
+func initLogger() {
+	level := initLogLevel()
+
+	format, found := os.LookupEnv("LOG_FORMAT")
+	if !found || format == "" {
+		format = "text"
+	}
+	switch format {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	case "text":
+		// Keep the standard log output format for interactive use.
+		slog.SetLogLoggerLevel(level)
+	default:
+		slog.SetLogLoggerLevel(level)
+		log.Printf("Invalid LOG_FORMAT value: %q, expected text or json; using text", format)
+	}
+}
+
+func initLogLevel() slog.Level {
+	levelStr, found := os.LookupEnv("LOG_LEVEL")
+	if !found || levelStr == "" {
+		return slog.LevelInfo
+	}
+	switch strings.ToLower(levelStr) {
+	case "debug":
+		return slog.LevelDebug
+	case "info":
+		return slog.LevelInfo
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		log.Printf("Invalid LOG_LEVEL value: %q, expected debug, info, warn or error; defaulting to info", levelStr)
+		return slog.LevelInfo
+	}
+}
@@ -2,22 +2,106 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math/rand"
 	"os"
+	"os/signal"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api/write"
 
 	"go.bug.st/serial"
 )
 
+func initSerialMode() *serial.Mode {
+	return &serial.Mode{
+		BaudRate: initBaudRate(),
+		Parity:   initParity(),
+		DataBits: initDataBits(),
+		StopBits: initStopBits(),
+	}
+}
+
+var parities = map[string]serial.Parity{
+	"none": serial.NoParity,
+	"even": serial.EvenParity,
+	"odd":  serial.OddParity,
+}
+
+// initParity returns UART_PARITY (none, even or odd), defaulting to none.
+func initParity() serial.Parity {
+	parityStr, found := os.LookupEnv("UART_PARITY")
+	if !found {
+		return serial.NoParity
+	}
+	parity, ok := parities[strings.ToLower(parityStr)]
+	if !ok {
+		log.Printf("Invalid UART_PARITY value: %q, must be none, even or odd; defaulting to none", parityStr)
+		return serial.NoParity
+	}
+	return parity
+}
+
+// initDataBits returns UART_DATABITS (7 or 8), defaulting to 8.
+func initDataBits() int {
+	bitsStr, found := os.LookupEnv("UART_DATABITS")
+	if !found {
+		return 8
+	}
+	bits, err := strconv.Atoi(bitsStr)
+	if err != nil || (bits != 7 && bits != 8) {
+		log.Printf("Invalid UART_DATABITS value: %q, must be 7 or 8; defaulting to 8", bitsStr)
+		return 8
+	}
+	return bits
+}
+
+// initStopBits returns UART_STOPBITS (1 or 2), defaulting to 1.
+func initStopBits() serial.StopBits {
+	bitsStr, found := os.LookupEnv("UART_STOPBITS")
+	if !found {
+		return serial.OneStopBit
+	}
+	switch bitsStr {
+	case "1":
+		return serial.OneStopBit
+	case "2":
+		return serial.TwoStopBits
+	}
+	log.Printf("Invalid UART_STOPBITS value: %q, must be 1 or 2; defaulting to 1", bitsStr)
+	return serial.OneStopBit
+}
+
+// serialFraming formats mode's character framing in the usual notation,
+// e.g. 8N1.
+func serialFraming(mode *serial.Mode) string {
+	parity := "N"
+	switch mode.Parity {
+	case serial.EvenParity:
+		parity = "E"
+	case serial.OddParity:
+		parity = "O"
+	}
+	stopBits := "1"
+	if mode.StopBits == serial.TwoStopBits {
+		stopBits = "2"
+	}
+	return fmt.Sprintf("%d%s%s", mode.DataBits, parity, stopBits)
+}
+
 func initConn() (io.ReadWriteCloser, error) {
+	mode := initSerialMode()
 	// device name from env variable, if not set uartreg.Open will open the first available device
-	uartport := os.Getenv("UART_DEV")
+	uartport, _ := lookupEnv("UART_DEV")
 	if uartport == "" {
 		ports, err := serial.GetPortsList()
 		if err != nil {
@@ -27,42 +111,171 @@ func initConn() (io.ReadWriteCloser, error) {
 			return nil, fmt.Errorf("no serial ports found")
 		}
 		uartport = ports[0]
+		if initAutodetect() {
+			if detected, ok := detectSensorPort(ports, mode); ok {
+				uartport = detected
+			} else {
+				log.Printf("No port answered the sensor probe, falling back to %s", uartport)
+			}
+		}
 	}
+	return openConn(uartport, mode)
+}
+
+// openConn opens uartport with mode and applies the read timeout. Ports named
+// tcp://host:port or rfc2217://host:port are reached over the network.
+func openConn(uartport string, mode *serial.Mode) (io.ReadWriteCloser, error) {
 	log.Printf("UART device: %s", uartport)
-	mode := &serial.Mode{
-		BaudRate: 9600,
-		Parity:   serial.NoParity,
-		DataBits: 8,
-		StopBits: serial.OneStopBit,
+	log.Printf("UART baud rate: %d", mode.BaudRate)
+	if isNetworkDevice(uartport) {
+		return openNetConn(uartport, mode, initReadTimeout())
 	}
 	p, err := serial.Open(uartport, mode)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open UART port %s: %v", uartport, err)
 	}
+	if err := p.SetReadTimeout(initReadTimeout()); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("failed to set read timeout on UART port %s: %v", uartport, err)
+	}
 
 	return p, nil
 }
 
+const defaultBaudRate = 9600
+
+// supportedBaudRates lists the standard UART rates accepted via UART_BAUD.
+var supportedBaudRates = []int{2400, 4800, 9600, 19200, 38400, 57600, 115200}
+
+func initBaudRate() int {
+	baudStr, found := lookupEnv("UART_BAUD")
+	if !found {
+		return defaultBaudRate
+	}
+	baud, err := strconv.Atoi(baudStr)
+	if err != nil {
+		log.Printf("Invalid UART_BAUD value: %v, defaulting to %d", err, defaultBaudRate)
+		return defaultBaudRate
+	}
+	for _, rate := range supportedBaudRates {
+		if baud == rate {
+			return baud
+		}
+	}
+	log.Printf("Unsupported UART_BAUD value: %d, defaulting to %d", baud, defaultBaudRate)
+	return defaultBaudRate
+}
+
 type Result struct {
 	Co2Concentration float32
+	Temperature      float32
+	// NoTemperature is set when the temperature byte decodes to an
+	// implausible value, as with clones that leave it at 0x00 or 0xFF.
+	// Temperature is then meaningless and is not recorded.
+	NoTemperature bool
+	// Co2Raw is the concentration as the sensor reported it when
+	// Co2Concentration has been corrected or filtered, and zero otherwise.
+	Co2Raw float32
+	// RawCo2 is the unclamped concentration some firmware reports in bytes 6
+	// and 7, or zero when the sensor leaves them empty.
+	RawCo2 float32
+	// Status is byte 5 of the response, used as a status flag by some
+	// variants. See statusNominal.
+	Status byte
+	// Frame is the raw response the result was parsed from.
+	Frame [cmdSize]byte
+
+	// Co2Rate is the change in ppm per minute since the previous reading,
+	// valid only when HasCo2Rate is set.
+	Co2Rate    float32
+	HasCo2Rate bool
+
+	// Co2Min, Co2Max and SampleCount summarize the readings averaged into a
+	// REPORT_INTERVAL report. SampleCount is zero for single readings.
+	Co2Min      float32
+	Co2Max      float32
+	SampleCount int
+
+	// Derived holds extra fields computed by computeDerived, keyed by field
+	// name.
+	Derived map[string]float32
+
+	// Time and Tags are filled in by doIt: when the reading was taken, in
+	// the configured timezone, and the static tags of its sensor loop.
+	Time time.Time
+	Tags map[string]string
+}
+
+// statusNominal reports whether status is one of the values observed from
+// healthy sensors: 0x00 from units that leave the byte unused and 0x40 from
+// MH-Z19B/C firmware during normal operation. No other codes are documented
+// by the manufacturer, so anything else is surfaced as informational rather
+// than treated as a failure.
+func statusNominal(status byte) bool {
+	return status == 0x00 || status == 0x40
 }
 
 const cmdSize = 9
 
-// Byte0: 0xFF, Byte1: 0x01, Byte2: 0x86, Byte3～7: 0x00, Byte8: Checksum
-func buildCommand() []byte {
+// defaultReadTimeout bounds how long read waits for a complete response frame.
+const defaultReadTimeout = 1 * time.Second
+
+// errReadTimeout marks reads where the sensor stopped answering mid-frame.
+var errReadTimeout = errors.New("read timed out")
+
+// errNoResponse marks timeouts where not a single byte arrived, which usually
+// points at wiring rather than a misbehaving sensor.
+var errNoResponse = errors.New("no bytes received")
+
+func initReadTimeout() time.Duration {
+	timeoutStr, found := os.LookupEnv("READ_TIMEOUT_MS")
+	if !found {
+		return defaultReadTimeout
+	}
+	timeoutMs, err := strconv.Atoi(timeoutStr)
+	if err != nil {
+		log.Printf("Invalid READ_TIMEOUT_MS value: %v, defaulting to %v", err, defaultReadTimeout)
+		return defaultReadTimeout
+	}
+	if timeoutMs <= 0 {
+		log.Printf("READ_TIMEOUT_MS must be positive, defaulting to %v", defaultReadTimeout)
+		return defaultReadTimeout
+	}
+	return time.Duration(timeoutMs) * time.Millisecond
+}
+
+// newCommand returns a frame for the given command byte with all data bytes
+// zeroed. Callers fill in data bytes and then set cmd[8] = checksum(cmd).
+func newCommand(command byte) []byte {
 	cmd := make([]byte, cmdSize)
 	cmd[0] = 0xFF
 	cmd[1] = 0x01
-	cmd[2] = 0x86
-	for i := 3; i < 8; i++ {
-		cmd[i] = 0x00
-	}
-	sum := 0
-	for i := 1; i < 8; i++ {
-		sum += int(cmd[i])
-	}
-	cmd[8] = byte(0xFF - sum + 1)
+	cmd[2] = command
+	return cmd
+}
+
+// cmdRead is the gas concentration read command. The sensor echoes the
+// command byte in byte 1 of its response.
+const cmdRead byte = 0x86
+
+// Byte0: 0xFF, Byte1: 0x01, Byte2: 0x86, Byte3～7: 0x00, Byte8: Checksum
+func buildCommand() []byte {
+	cmd := newCommand(cmdRead)
+	cmd[8] = checksum(cmd)
+	return cmd
+}
+
+// Byte0: 0xFF, Byte1: 0x01, Byte2: 0x87, Byte3～7: 0x00, Byte8: Checksum
+func buildZeroCalibrationCommand() []byte {
+	cmd := newCommand(0x87)
+	cmd[8] = checksum(cmd)
+	return cmd
+}
+
+// Byte0: 0xFF, Byte1: 0x01, Byte2: 0xA0, Byte3～7: 0x00, Byte8: Checksum
+func buildVersionCommand() []byte {
+	cmd := newCommand(0xA0)
+	cmd[8] = checksum(cmd)
 	return cmd
 }
 
@@ -74,84 +287,694 @@ func checksum(response []byte) byte {
 	return byte(0xFF - sum + 1)
 }
 
-func read(dev io.ReadWriter, cmd []byte) (Result, error) {
-	response := make([]byte, cmdSize)
+// readFrame reads into buf until it is full or timeout elapses. A single Read
+// may return only part of a frame, so bytes are accumulated across calls.
+func readFrame(dev io.Reader, buf []byte, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	total := 0
+	for total < len(buf) && time.Now().Before(deadline) {
+		n, err := dev.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// maxResyncBytes bounds how many leading bytes resyncFrame may discard.
+const maxResyncBytes = 2 * cmdSize
 
+// resyncFrame realigns frame on the 0xFF <echo> start sequence. Leading bytes
+// up to the next 0xFF are discarded and the tail is refilled from dev, so a
+// stale partial frame left by an earlier read doesn't poison later ones.
+func resyncFrame(dev io.Reader, frame []byte, echo byte, timeout time.Duration) (int, error) {
+	discarded := 0
+	for frame[0] != 0xFF || frame[1] != echo {
+		skip := 1
+		for skip < len(frame) && frame[skip] != 0xFF {
+			skip++
+		}
+		discarded += skip
+		if discarded > maxResyncBytes {
+			return discarded, fmt.Errorf("frame desync: no 0xFF %02X start sequence within %d bytes", echo, maxResyncBytes)
+		}
+		copy(frame, frame[skip:])
+		n, err := readFrame(dev, frame[len(frame)-skip:], timeout)
+		if err != nil {
+			return discarded, fmt.Errorf("frame desync: failed to read while realigning: %v", err)
+		}
+		if n < skip {
+			return discarded, fmt.Errorf("frame desync: response ended after discarding %d byte(s)", discarded)
+		}
+	}
+	return discarded, nil
+}
+
+// Byte0: 0xFF, Byte1: 0x01, Byte2: 0x88, Byte3: ppm high, Byte4: ppm low, Byte5～7: 0x00, Byte8: Checksum
+func buildSpanCalibrationCommand(ppm uint16) []byte {
+	cmd := newCommand(0x88)
+	cmd[3] = byte(ppm / 256)
+	cmd[4] = byte(ppm % 256)
+	cmd[8] = checksum(cmd)
+	return cmd
+}
+
+// Byte0: 0xFF, Byte1: 0x01, Byte2: 0x79, Byte3: 0xA0 (on) / 0x00 (off), Byte4～7: 0x00, Byte8: Checksum
+func buildABCCommand(enable bool) []byte {
+	cmd := newCommand(0x79)
+	if enable {
+		cmd[3] = 0xA0
+	}
+	cmd[8] = checksum(cmd)
+	return cmd
+}
+
+// Byte0: 0xFF, Byte1: 0x01, Byte2: 0x99, Byte3～5: 0x00, Byte6: range high, Byte7: range low, Byte8: Checksum
+func buildRangeCommand(ppm uint16) []byte {
+	cmd := newCommand(0x99)
+	cmd[6] = byte(ppm / 256)
+	cmd[7] = byte(ppm % 256)
+	cmd[8] = checksum(cmd)
+	return cmd
+}
+
+func writeCommand(dev io.Writer, cmd []byte) error {
 	n, err := dev.Write(cmd)
 	if err != nil {
-		return Result{}, fmt.Errorf("failed to send command: %v", err)
+		return fmt.Errorf("failed to send command: %w", err)
 	}
 	if n != len(cmd) {
-		return Result{}, fmt.Errorf("failed to send command: %d bytes sent, expected %d", n, len(cmd))
+		return fmt.Errorf("failed to send command: %d bytes sent, expected %d", n, len(cmd))
+	}
+	return nil
+}
+
+// errVersionNotSupported marks sensors that don't answer the firmware version
+// command; only some MH-Z19 revisions implement it.
+var errVersionNotSupported = errors.New("firmware version command not supported by this sensor")
+
+// readVersion queries the firmware version, which the sensor returns as four
+// ASCII characters in bytes 2-5, e.g. "0443".
+func readVersion(dev io.ReadWriter) (string, error) {
+	flushInput(dev)
+	if err := writeCommand(dev, buildVersionCommand()); err != nil {
+		return "", err
+	}
+	time.Sleep(initCommandDelay())
+
+	response := make([]byte, cmdSize)
+	timeout := initReadTimeout()
+	received, err := readFrame(dev, response, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to read version response: %v", err)
+	}
+	slog.Debug("received version response", "frame", fmt.Sprintf("% x", response[:received]))
+	if received == 0 {
+		return "", fmt.Errorf("%w: no answer within %v", errVersionNotSupported, timeout)
+	}
+	if received < cmdSize {
+		return "", fmt.Errorf("%w after %v: version response too short, %d of %d bytes", errReadTimeout, timeout, received, cmdSize)
+	}
+	if response[0] != 0xFF || response[1] != 0xA0 {
+		return "", fmt.Errorf("%w: unexpected response header %02X %02X", errVersionNotSupported, response[0], response[1])
 	}
+	if response[8] != checksum(response) {
+		return "", fmt.Errorf("invalid checksum: %02X", response[8])
+	}
+	version := strings.TrimRight(string(response[2:6]), "\x00 ")
+	for _, c := range version {
+		if c < 0x20 || c > 0x7E {
+			return "", fmt.Errorf("%w: non-ASCII version bytes % X", errVersionNotSupported, response[2:6])
+		}
+	}
+	return version, nil
+}
+
+// calibrateZero sets the current concentration as the 400ppm zero point.
+// The sensor does not answer this command, so only the write is checked.
+func calibrateZero(dev io.ReadWriter) error {
+	if err := writeCommand(dev, buildZeroCalibrationCommand()); err != nil {
+		return fmt.Errorf("zero calibration failed: %v", err)
+	}
+	return nil
+}
+
+const (
+	minSpanPPM = 1000
+	maxSpanPPM = 5000
+)
+
+// calibrateSpan calibrates the sensor against a known concentration in ppm.
+// Zero calibration must have been performed beforehand.
+func calibrateSpan(dev io.ReadWriter, ppm uint16) error {
+	if ppm < minSpanPPM || ppm > maxSpanPPM {
+		return fmt.Errorf("span calibration target %d ppm out of supported range %d-%d", ppm, minSpanPPM, maxSpanPPM)
+	}
+	if err := writeCommand(dev, buildSpanCalibrationCommand(ppm)); err != nil {
+		return fmt.Errorf("span calibration failed: %v", err)
+	}
+	return nil
+}
+
+// setABC turns the sensor's automatic baseline calibration on or off.
+func setABC(dev io.ReadWriter, enable bool) error {
+	if err := writeCommand(dev, buildABCCommand(enable)); err != nil {
+		return fmt.Errorf("failed to set ABC logic: %v", err)
+	}
+	return nil
+}
+
+// supportedDetectionRanges lists the full-scale ranges the MH-Z19C accepts.
+var supportedDetectionRanges = []uint16{2000, 5000}
+
+// setRange sets the sensor's detection range (full scale) in ppm.
+func setRange(dev io.ReadWriter, ppm uint16) error {
+	for _, r := range supportedDetectionRanges {
+		if ppm == r {
+			if err := writeCommand(dev, buildRangeCommand(ppm)); err != nil {
+				return fmt.Errorf("failed to set detection range: %v", err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported detection range %d ppm, expected one of %v", ppm, supportedDetectionRanges)
+}
+
+// initDetectionRange reports the DETECTION_RANGE requested at startup. ok is
+// false when it is unset or invalid, in which case the sensor is left as is.
+func initDetectionRange() (ppm uint16, ok bool) {
+	rangeStr, found := os.LookupEnv("DETECTION_RANGE")
+	if !found || rangeStr == "" {
+		return 0, false
+	}
+	parsed, err := strconv.Atoi(rangeStr)
+	if err != nil {
+		log.Printf("Invalid DETECTION_RANGE value: %v, leaving sensor setting unchanged", err)
+		return 0, false
+	}
+	for _, r := range supportedDetectionRanges {
+		if parsed == int(r) {
+			return r, true
+		}
+	}
+	log.Printf("Unsupported DETECTION_RANGE value: %d, expected one of %v; leaving sensor setting unchanged", parsed, supportedDetectionRanges)
+	return 0, false
+}
+
+// initABC reports the requested ABC state from ABC_LOGIC. ok is false when
+// the variable is unset or invalid, in which case the sensor is left as is.
+func initABC() (enable bool, ok bool) {
+	abc, found := os.LookupEnv("ABC_LOGIC")
+	if !found || abc == "" {
+		return false, false
+	}
+	switch abc {
+	case "on":
+		return true, true
+	case "off":
+		return false, true
+	default:
+		log.Printf("Invalid ABC_LOGIC value: %q, expected on or off; leaving sensor setting unchanged", abc)
+		return false, false
+	}
+}
+
+// readConfig holds the tunables applied to every read.
+type readConfig struct {
+	// CommandDelay is the pause between sending a command and reading the
+	// response.
+	CommandDelay time.Duration
+	// MaxPPM is the highest concentration accepted as plausible.
+	MaxPPM float32
+	// ReadTimeout bounds the wait for a complete response frame.
+	ReadTimeout time.Duration
+	// FlushInput discards stale buffered input before each command.
+	FlushInput bool
+	// ChecksumMode is one of checksumStrict, checksumWarn or
+	// checksumIgnore.
+	ChecksumMode string
+}
 
-	time.Sleep(150 * time.Millisecond)
+func initReadConfig() readConfig {
+	return readConfig{
+		CommandDelay: initCommandDelay(),
+		MaxPPM:       initMaxPPM(),
+		ReadTimeout:  initReadTimeout(),
+		FlushInput:   initFlushBeforeRead(),
+		ChecksumMode: initChecksumMode(),
+	}
+}
 
-	_, err = dev.Read(response)
+// CHECKSUM_MODE values. Some clones compute the checksum differently or not
+// at all; warn and ignore let their readings through.
+const (
+	checksumStrict = "strict"
+	checksumWarn   = "warn"
+	checksumIgnore = "ignore"
+)
+
+// checksums logs the received and computed checksums in warn and ignore
+// modes. Both change with every reading, so after the first frame it only
+// logs when neither the received byte nor its difference to the computed one
+// repeats the last report: a clone that sends a fixed byte or a fixed offset
+// is reported once, not on every read.
+var checksums checksumReporter
+
+type checksumReporter struct {
+	mu       sync.Mutex
+	logged   bool
+	received byte
+	delta    byte
+}
+
+func (c *checksumReporter) report(mode string, received, computed byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	attrs := []any{"mode", mode, "received", fmt.Sprintf("%02X", received), "computed", fmt.Sprintf("%02X", computed)}
+	delta := received - computed
+	if c.logged && (received == c.received || delta == c.delta) {
+		slog.Debug("checksum compared", attrs...)
+		return
+	}
+	c.logged, c.received, c.delta = true, received, delta
+	if delta == 0 {
+		slog.Info("checksum matches", attrs...)
+	} else {
+		slog.Warn("checksum mismatch, using reading anyway", attrs...)
+	}
+}
+
+func initChecksumMode() string {
+	mode, found := os.LookupEnv("CHECKSUM_MODE")
+	if !found || mode == "" {
+		return checksumStrict
+	}
+	switch mode {
+	case checksumStrict:
+	case checksumWarn, checksumIgnore:
+		log.Printf("WARNING: CHECKSUM_MODE=%s, corrupted frames may be accepted", mode)
+	default:
+		log.Printf("Invalid CHECKSUM_MODE value: %q, defaulting to %s", mode, checksumStrict)
+		return checksumStrict
+	}
+	return mode
+}
+
+func initFlushBeforeRead() bool {
+	flushStr, found := os.LookupEnv("FLUSH_BEFORE_READ")
+	if !found {
+		return true
+	}
+	flush, err := strconv.ParseBool(flushStr)
+	if err != nil {
+		log.Printf("Invalid FLUSH_BEFORE_READ value: %v, defaulting to true", err)
+		return true
+	}
+	return flush
+}
+
+// inputResetter is implemented by ports that can discard buffered input, such
+// as serial.Port.
+type inputResetter interface {
+	ResetInputBuffer() error
+}
+
+// flushInput drops bytes left over from an earlier cycle so they are not
+// parsed as part of the next response. Ports without buffer reset support
+// are left alone.
+func flushInput(dev io.ReadWriter) {
+	r, ok := dev.(inputResetter)
+	if !ok {
+		return
+	}
+	if err := r.ResetInputBuffer(); err != nil {
+		slog.Warn("failed to flush serial input buffer", "error", err)
+	}
+}
+
+// minPPM is the sensor's hardware floor; lower readings are glitches.
+const minPPM = 400
+
+// errImplausibleConcentration marks readings outside [minPPM, MaxPPM].
+var errImplausibleConcentration = errors.New("implausible CO2 concentration")
+
+func read(dev io.ReadWriter, cmd []byte, cfg readConfig) (_ Result, err error) {
+	readsTotal.Inc()
+	defer func() {
+		if err != nil {
+			readErrorsTotal.Inc()
+		}
+	}()
+
+	if cfg.FlushInput {
+		flushInput(dev)
+	}
+	slog.Debug("sending command", "frame", fmt.Sprintf("% x", cmd))
+	if err := writeCommand(dev, cmd); err != nil {
+		return Result{}, err
+	}
+
+	time.Sleep(cfg.CommandDelay)
+
+	// The response echoes the command that was sent.
+	return readResponse(dev, cmd[2], cfg)
+}
+
+// readResponse reads one frame starting 0xFF echo, realigning on it if
+// needed, and decodes it into a plausible reading. Whatever bytes arrived are
+// kept in rawFrames with the outcome, for /debug/frame.
+func readResponse(dev io.Reader, echo byte, cfg readConfig) (_ Result, err error) {
+	response := make([]byte, cmdSize)
+	received, err := readFrame(dev, response, cfg.ReadTimeout)
 	if err != nil {
 		return Result{}, fmt.Errorf("failed to read response: %v", err)
 	}
+	if received > 0 {
+		defer func() { rawFrames.record(response[:received], err) }()
+	}
 
-	if len(response) < cmdSize {
-		return Result{}, fmt.Errorf("response too short: %d bytes, expected %d", len(response), cmdSize)
+	if received == 0 {
+		return Result{}, fmt.Errorf("%w after %v: %w", errReadTimeout, cfg.ReadTimeout, errNoResponse)
 	}
-	if response[0] != 0xFF || response[1] != 0x86 {
-		return Result{}, fmt.Errorf("invalid response header: %02X %02X", response[0], response[1])
+	if received < cmdSize {
+		slog.Debug("received partial response", "frame", fmt.Sprintf("% x", response[:received]))
+		return Result{}, fmt.Errorf("%w after %v: response too short, %d of %d bytes", errReadTimeout, cfg.ReadTimeout, received, cmdSize)
+	}
+	if response[0] != 0xFF || response[1] != echo {
+		slog.Warn("invalid response header, resynchronizing", "header", fmt.Sprintf("%02X %02X", response[0], response[1]))
+		discarded, err := resyncFrame(dev, response, echo, cfg.ReadTimeout)
+		if err != nil {
+			return Result{}, err
+		}
+		slog.Info("resynchronized response frame", "discarded_bytes", discarded)
 	}
 
-	if response[8] != checksum(response) {
+	slog.Debug("received response", "frame", fmt.Sprintf("% x", response), "checksum_ok", response[8] == checksum(response))
+	result, err := parseResponseChecksum(response, echo, cfg.ChecksumMode)
+	if err != nil {
+		return Result{}, err
+	}
+	if result.Co2Concentration < minPPM || result.Co2Concentration > cfg.MaxPPM {
+		rejectedSamplesTotal.Inc()
+		return Result{}, fmt.Errorf("%w: %.0f ppm outside %d-%.0f", errImplausibleConcentration, result.Co2Concentration, minPPM, cfg.MaxPPM)
+	}
+	if !statusNominal(result.Status) {
+		slog.Info("sensor reported unrecognized status", "status", fmt.Sprintf("0x%02X", result.Status))
+	}
+	return result, nil
+}
+
+// The plausible temperature range of the sensor. The lower bound is
+// exclusive: -40 is what a zero byte decodes to.
+const (
+	minTemperature = -40
+	maxTemperature = 80
+)
+
+func temperaturePlausible(temperature float32) bool {
+	return temperature > minTemperature && temperature <= maxTemperature
+}
+
+// parseResponse decodes a read (0x86) response frame. It checks the header
+// and checksum but not whether the concentration is plausible.
+func parseResponse(response []byte) (Result, error) {
+	return parseResponseChecksum(response, cmdRead, checksumStrict)
+}
+
+// parseResponseChecksum is parseResponse for a frame echoing the command byte
+// echo, with the checksum handling of mode.
+func parseResponseChecksum(response []byte, echo byte, mode string) (Result, error) {
+	if len(response) != cmdSize {
+		return Result{}, fmt.Errorf("invalid response length: %d bytes, want %d", len(response), cmdSize)
+	}
+	if response[0] != 0xFF || response[1] != echo {
+		return Result{}, fmt.Errorf("invalid response header: %02X %02X", response[0], response[1])
+	}
+	computed := checksum(response)
+	switch {
+	case mode == checksumWarn || mode == checksumIgnore:
+		checksums.report(mode, response[8], computed)
+	case response[8] != computed:
 		return Result{}, fmt.Errorf("invalid checksum: %02X", response[8])
 	}
 
 	high := int(response[2])
 	low := int(response[3])
 	concentration := float32(high*256 + low)
-	return Result{Co2Concentration: concentration}, nil
+	// Byte4 carries the approximate temperature offset by 40
+	temperature := float32(int(response[4]) - 40)
+	// Byte6/7 carry the unlimited (unclamped) value on some firmware
+	rawCo2 := float32(int(response[6])*256 + int(response[7]))
+	// Byte5 is a status flag on some variants
+	status := response[5]
+	result := Result{
+		Co2Concentration: concentration,
+		Temperature:      temperature,
+		NoTemperature:    !temperaturePlausible(temperature),
+		RawCo2:           rawCo2,
+		Status:           status,
+	}
+	copy(result.Frame[:], response)
+	return result, nil
+}
+
+// readWithRetry re-issues cmd up to attempts times, sleeping backoff between
+// tries, and returns the last error if every attempt fails.
+func readWithRetry(dev io.ReadWriter, cmd []byte, cfg readConfig, attempts int, backoff time.Duration) (Result, error) {
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			slog.Warn("read attempt failed, retrying", "attempt", i, "attempts", attempts, "error", lastErr)
+			time.Sleep(backoff)
+		}
+		result, err := read(dev, cmd, cfg)
+		if err == nil {
+			return result, nil
+		}
+		lastErr = err
+	}
+	return Result{}, fmt.Errorf("all %d read attempts failed: %w", attempts, lastErr)
 }
 
 func initInfo() (InfluxDBInfo, error) {
-	org, found := os.LookupEnv("INFLUXDB_ORG")
-	if !found {
-		org = "lemolatoon"
+	version := initInfluxVersion()
+	var org, bucket string
+	var defaulted []string
+	if version == 1 {
+		var err error
+		bucket, err = initV1Bucket()
+		if err != nil {
+			return InfluxDBInfo{}, err
+		}
+	} else {
+		if value, found := lookupEnv("INFLUXDB_ORG"); found {
+			org = strings.TrimSpace(value)
+		}
+		if org == "" {
+			org = "lemolatoon"
+			defaulted = append(defaulted, "INFLUXDB_ORG")
+		}
+		if value, found := lookupEnv("INFLUXDB_BUCKET"); found {
+			bucket = strings.TrimSpace(value)
+		}
+		if bucket == "" {
+			bucket = "sensor-home"
+			defaulted = append(defaulted, "INFLUXDB_BUCKET")
+		}
+	}
+	measurement, found := os.LookupEnv("INFLUXDB_MEASUREMENT")
+	if !found || measurement == "" {
+		measurement = "sensor_data"
 	}
-	bucket, found := os.LookupEnv("INFLUXDB_BUCKET")
+	url, found := lookupEnv("INFLUXDB_URL")
 	if !found {
-		bucket = "sensor-home"
+		url = "http://localhost:8086"
+	}
+	targets, err := parseTargets(org, bucket)
+	if err != nil {
+		return InfluxDBInfo{}, err
 	}
-	return InfluxDBInfo{Org: org, Bucket: bucket}, nil
+	return InfluxDBInfo{Version: version, URL: url, Org: org, Bucket: bucket, Targets: targets, Measurement: measurement, TemperatureMeasurement: initTemperatureMeasurement(), Tags: initTags(), Defaulted: defaulted}, nil
 }
 
 type InfluxDBInfo struct {
-	Org    string
-	Bucket string
+	// Version is the InfluxDB major version (1 or 2). For 1.x servers Org is
+	// empty and Bucket holds "database/retention-policy".
+	Version int
+	URL     string
+	Org     string
+	Bucket  string
+	// Targets lists every org/bucket pair written to, parsed from the
+	// comma-separated Org and Bucket settings.
+	Targets     []influxTarget
+	Measurement string
+	// TemperatureMeasurement receives the temperature field when
+	// SPLIT_MEASUREMENTS is set, and is empty otherwise.
+	TemperatureMeasurement string
+	Tags                   map[string]string
+	// Defaulted lists the org and bucket settings left unset, which fell
+	// back to the built-in defaults.
+	Defaulted []string
+}
+
+// initTags returns the static tags attached to every point. The sensor and
+// host tags, and the location tag when LOCATION is set, are always present
+// unless INFLUXDB_TAGS (key=value,key2=value2) overrides them.
+func initTags() map[string]string {
+	tags := map[string]string{
+		"sensor": "MH-Z19C",
+	}
+	if host, err := os.Hostname(); err != nil {
+		log.Printf("Failed to get hostname, omitting host tag: %v", err)
+	} else {
+		tags["host"] = host
+	}
+	if location, found := os.LookupEnv("LOCATION"); found && location != "" {
+		tags["location"] = location
+	}
+	tagsStr := os.Getenv("INFLUXDB_TAGS")
+	for _, pair := range strings.Split(tagsStr, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			log.Printf("Ignoring malformed INFLUXDB_TAGS entry: %q", pair)
+			continue
+		}
+		tags[key] = value
+	}
+	log.Printf("Host tag: %q", tags["host"])
+	return tags
+}
+
+// fallbackZones holds fixed offsets for zones that must keep working without
+// tzdata (e.g. in a minimal container image).
+var fallbackZones = map[string]int{
+	"Asia/Tokyo": 9 * 60 * 60,
 }
 
 func initLocation() *time.Location {
-	loc, err := time.LoadLocation("Asia/Tokyo")
+	name, found := os.LookupEnv("TZ_LOCATION")
+	if !found || name == "" {
+		name = "Asia/Tokyo"
+	}
+	loc, err := time.LoadLocation(name)
 	if err != nil {
-		log.Printf("Failed to laod Asia/Tokyo timezone: %v", err)
-		loc = time.FixedZone("Asia/Tokyo", 9*60*60) // fallback
+		log.Printf("Failed to load %s timezone: %v", name, err)
+		if offset, ok := fallbackZones[name]; ok {
+			loc = time.FixedZone(name, offset) // fallback
+		} else {
+			loc = time.UTC
+		}
 	}
+	log.Printf("Timezone: %s", loc)
 	return loc
 }
 
-func send(client influxdb2.Client, info InfluxDBInfo, loc *time.Location, result *Result) {
-	writeAPI := client.WriteAPIBlocking(info.Org, info.Bucket)
-	tags := map[string]string{
-		"sensor": "MH-Z19C",
+// unclampedDiffers reports whether the unlimited value carries information not
+// already in the clamped concentration.
+func unclampedDiffers(result *Result) bool {
+	if result.RawCo2 == 0 {
+		return false
+	}
+	measured := result.Co2Concentration
+	if result.Co2Raw != 0 {
+		measured = result.Co2Raw
+	}
+	diff := result.RawCo2 - measured
+	return diff >= 1 || diff <= -1
+}
+
+func send(ctx context.Context, sink Sink, result *Result) error {
+	err := sink.Write(ctx, result)
+	if err != nil && !errors.Is(err, errWritesSuspended) {
+		slog.Error("error writing reading", "error", err)
 	}
-	fields := map[string]interface{}{
-		"co2_concentration": result.Co2Concentration,
+	return err
+}
+
+const retryBackoff = 200 * time.Millisecond
+
+const defaultMaxPPM = 5000
+
+func initMaxPPM() float32 {
+	maxStr, found := os.LookupEnv("CO2_MAX_PPM")
+	if !found {
+		return defaultMaxPPM
+	}
+	maxPPM, err := strconv.Atoi(maxStr)
+	if err != nil {
+		log.Printf("Invalid CO2_MAX_PPM value: %v, defaulting to %d", err, defaultMaxPPM)
+		return defaultMaxPPM
 	}
-	point := write.NewPoint("sensor_data", tags, fields, time.Now().In(loc))
+	if maxPPM <= minPPM {
+		log.Printf("CO2_MAX_PPM must be above %d, defaulting to %d", minPPM, defaultMaxPPM)
+		return defaultMaxPPM
+	}
+	return float32(maxPPM)
+}
+
+const (
+	defaultCommandDelay = 150 * time.Millisecond
+	maxCommandDelay     = 2 * time.Second
+)
 
-	if err := writeAPI.WritePoint(context.Background(), point); err != nil {
-		log.Printf("Error writing point: %v", err)
+// initCommandDelay returns how long read waits between sending a command and
+// reading the response.
+func initCommandDelay() time.Duration {
+	delayStr, found := os.LookupEnv("COMMAND_DELAY_MS")
+	if !found {
+		return defaultCommandDelay
+	}
+	delayMs, err := strconv.Atoi(delayStr)
+	if err != nil {
+		log.Printf("Invalid COMMAND_DELAY_MS value: %v, defaulting to %v", err, defaultCommandDelay)
+		return defaultCommandDelay
 	}
+	if delayMs <= 0 {
+		log.Printf("COMMAND_DELAY_MS must be positive, defaulting to %v", defaultCommandDelay)
+		return defaultCommandDelay
+	}
+	delay := time.Duration(delayMs) * time.Millisecond
+	if delay > maxCommandDelay {
+		log.Printf("COMMAND_DELAY_MS too large, capping at %v", maxCommandDelay)
+		return maxCommandDelay
+	}
+	return delay
 }
 
+func initReadRetries() int {
+	retriesStr, found := os.LookupEnv("READ_RETRIES")
+	if !found {
+		retriesStr = "3"
+	}
+	retries, err := strconv.Atoi(retriesStr)
+	if err != nil {
+		log.Printf("Invalid READ_RETRIES value: %v, defaulting to 3", err)
+		retries = 3
+	}
+	if retries <= 0 {
+		log.Printf("READ_RETRIES must be positive, defaulting to 3")
+		retries = 3
+	}
+	return retries
+}
+
+// maxInterval bounds INTERVAL; anything longer is almost certainly a typo.
+const maxInterval = 24 * time.Hour
+
+// initSleepDuration returns the time between reads. INTERVAL, a Go duration
+// such as "30s" or "1m30s", takes precedence over the legacy
+// SLEEP_DURATION_SECONDS unless --interval was given.
 func initSleepDuration() time.Duration {
-	durationStr, found := os.LookupEnv("SLEEP_DURATION_SECONDS")
+	if interval, ok := initInterval(); ok {
+		return interval
+	}
+	durationStr, found := lookupEnv("SLEEP_DURATION_SECONDS")
 	if !found {
 		durationStr = "60"
 	}
@@ -167,49 +990,547 @@ func initSleepDuration() time.Duration {
 	return time.Duration(duration) * time.Second
 }
 
-func initClient() (influxdb2.Client, error) {
+func initInterval() (time.Duration, bool) {
+	if settingSource("SLEEP_DURATION_SECONDS") == "flag" {
+		return 0, false
+	}
+	intervalStr, found := os.LookupEnv("INTERVAL")
+	if !found || intervalStr == "" {
+		return 0, false
+	}
+	interval, err := parseInterval(intervalStr)
+	if err != nil {
+		log.Printf("Invalid INTERVAL value: %v, falling back to SLEEP_DURATION_SECONDS", err)
+		return 0, false
+	}
+	return interval, true
+}
+
+func parseInterval(s string) (time.Duration, error) {
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if interval <= 0 || interval > maxInterval {
+		return 0, fmt.Errorf("%v is not between 0 and %v", interval, maxInterval)
+	}
+	return interval, nil
+}
+
+// initSleepJitter reads SLEEP_JITTER_SECONDS, the upper bound of the random
+// delay added to each sleep. Zero disables jitter.
+func initSleepJitter() time.Duration {
+	jitterStr, found := os.LookupEnv("SLEEP_JITTER_SECONDS")
+	if !found {
+		return 0
+	}
+	jitter, err := strconv.Atoi(jitterStr)
+	if err != nil {
+		log.Printf("Invalid SLEEP_JITTER_SECONDS value: %v, disabling jitter", err)
+		return 0
+	}
+	if jitter < 0 {
+		log.Printf("SLEEP_JITTER_SECONDS must not be negative, disabling jitter")
+		return 0
+	}
+	return time.Duration(jitter) * time.Second
+}
+
+// jitteredSleep returns base plus a uniformly random offset in [0, jitter),
+// so a fleet started by the same timer spreads out its writes.
+func jitteredSleep(base, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return base
+	}
+	return base + time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// initToken prefers the token stored in INFLUXDB_TOKEN_FILE over the inline
+// INFLUXDB_TOKEN, so secrets can be mounted rather than passed in the
+// environment.
+func initToken() (string, error) {
+	if path, found := os.LookupEnv("INFLUXDB_TOKEN_FILE"); found && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read INFLUXDB_TOKEN_FILE %s: %v", path, err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("INFLUXDB_TOKEN_FILE %s is empty", path)
+		}
+		return token, nil
+	}
 	token, found := os.LookupEnv("INFLUXDB_TOKEN")
 	if !found {
-		return nil, fmt.Errorf("INFLUXDB_TOKEN not set")
+		return "", fmt.Errorf("neither INFLUXDB_TOKEN nor INFLUXDB_TOKEN_FILE is set")
 	}
-	url, found := os.LookupEnv("INFLUXDB_URL")
+	return token, nil
+}
+
+func initClient(info InfluxDBInfo) (influxdb2.Client, error) {
+	var token string
+	if info.Version == 1 {
+		var err error
+		token, err = initV1Token()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		token, err = initToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+	precision, err := initPrecision()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := initTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	options := clientOptions(initBatchSize(), precision, initGzip())
+	if tlsConfig != nil {
+		options.SetTLSConfig(tlsConfig)
+	}
+	return influxdb2.NewClientWithOptions(info.URL, token, options), nil
+}
+
+// warmup describes the grace period after startup during which readings are
+// logged but not sent, since the sensor takes a few minutes to stabilize.
+type warmup struct {
+	start    time.Time
+	duration time.Duration
+}
+
+func (w warmup) active(now time.Time) bool {
+	return now.Sub(w.start) < w.duration
+}
+
+func (w warmup) remaining(now time.Time) time.Duration {
+	return w.duration - now.Sub(w.start)
+}
+
+func initWarmupDuration() time.Duration {
+	warmupStr, found := os.LookupEnv("WARMUP_SECONDS")
 	if !found {
-		url = "http://localhost:8086"
+		warmupStr = "180"
+	}
+	seconds, err := strconv.Atoi(warmupStr)
+	if err != nil {
+		log.Printf("Invalid WARMUP_SECONDS value: %v, defaulting to 180 seconds", err)
+		seconds = 180
+	}
+	if seconds < 0 {
+		log.Printf("WARMUP_SECONDS must not be negative, defaulting to 180 seconds")
+		seconds = 180
 	}
-	return influxdb2.NewClient(url, token), nil
+	return time.Duration(seconds) * time.Second
 }
 
-func doIt(c io.ReadWriter, cmd []byte, client influxdb2.Client, info InfluxDBInfo, loc *time.Location) {
-	result, err := read(c, cmd)
+// doIt runs one read-and-send cycle. Errors are logged; the returned error
+// only tells one-shot mode whether the cycle succeeded.
+func doIt(ctx context.Context, d *Daemon, s *sensorLoop, cmd []byte) (err error) {
+	defer recoverCycle(s, &err)
+	result, err := readWithRetry(s.port, cmd, d.readCfg, d.retries, retryBackoff)
+	return handleReading(ctx, d, s, result, err)
+}
+
+// recoverCycle is deferred by every read cycle. A bug in one cycle must not
+// take down a long-running daemon, but it must not go unnoticed either.
+func recoverCycle(s *sensorLoop, err *error) {
+	if r := recover(); r != nil {
+		cyclePanicsTotal.Inc()
+		s.logger.Error("recovered from panic in read cycle", "panic", r, "stack", string(debug.Stack()))
+		*err = fmt.Errorf("panic in read cycle: %v", r)
+	}
+}
+
+// handleReading runs everything after the read itself: failure accounting,
+// filtering, alerts and finally the send. err is the error of the read that
+// produced result.
+func handleReading(ctx context.Context, d *Daemon, s *sensorLoop, result Result, err error) error {
+	recordHeartbeat(time.Now())
 	if err != nil {
-		log.Printf("Error reading data: %v", err)
-		return
+		s.logger.Error("error reading data", "error", err)
+		s.failures.Failure(err, time.Now())
+		s.port.recordError(ctx)
+		return err
 	}
-	log.Printf("CO2 Concentration: %.2f ppm", result.Co2Concentration)
-	send(client, info, loc, &result)
+	s.port.recordSuccess()
+	s.failures.Success(time.Now())
+	d.notifyReady()
+	readAt := time.Now()
+	result.Time = readAt.In(d.loc)
+	if s.stamps != nil {
+		// The aligned stamp is only for the point; freshness checks keep
+		// using readAt so a stalled loop still shows.
+		result.Time = s.stamps.Stamp(readAt).In(d.loc)
+	}
+	result.Tags = s.info.Tags
+	if s.stuck != nil && s.stuck.Observe(result.Frame) {
+		sensorStuck.Inc()
+		s.logger.Warn("sensor appears stuck: identical response frames", "frames", s.stuck.window, "frame", fmt.Sprintf("% x", result.Frame))
+		if s.stuck.reconnect {
+			s.port.reconnect(ctx)
+		}
+	}
+	if s.correction != nil {
+		result.Co2Raw = result.Co2Concentration
+		result.Co2Concentration = s.correction.Apply(result.Co2Concentration)
+	}
+	if s.step != nil && !s.step.Accept(result.Co2Concentration, result.Time) {
+		rejectedSamplesTotal.Inc()
+		rawFrames.record(result.Frame[:], fmt.Errorf("rejected implausible CO2 step to %.0f ppm", result.Co2Concentration))
+		s.logger.Warn("rejected implausible CO2 step", "co2", result.Co2Concentration, "previous", s.step.last, "consecutive_rejections", s.step.rejects)
+		return nil
+	}
+	d.latest.Set(result, readAt.In(d.loc))
+	d.history.Add(&result)
+	co2Gauge.Set(float64(result.Co2Concentration))
+	if !result.NoTemperature {
+		temperatureGauge.Set(float64(result.Temperature))
+	} else if !s.warnedTemperature {
+		s.warnedTemperature = true
+		s.logger.Warn("sensor does not appear to report temperature, omitting the temperature field", "temperature", result.Temperature)
+	}
+	s.logger.Debug("reading", "co2", result.Co2Concentration, "temperature", result.Temperature)
+	if s.smoother != nil {
+		if result.Co2Raw == 0 {
+			result.Co2Raw = result.Co2Concentration
+		}
+		result.Co2Concentration = s.smoother.Add(result.Co2Concentration)
+		s.logger.Debug("smoothed reading", "co2", result.Co2Concentration, "co2_raw", result.Co2Raw)
+	}
+	result.Co2Rate, result.HasCo2Rate = s.rate.Observe(result.Co2Concentration, result.Time)
+	if s.derived {
+		computeDerived(&result)
+	}
+	if now := time.Now(); d.warm.active(now) {
+		s.logger.Info("sensor warming up, not sending reading", "remaining", d.warm.remaining(now).Round(time.Second).String())
+		return nil
+	}
+	// Readings during the warm-up are unreliable and must not raise an
+	// alert either.
+	if s.alerter != nil {
+		s.alerter.Observe(result.Co2Concentration, result.Time)
+	}
+	if s.report != nil {
+		report, due := s.report.Add(result)
+		if !due {
+			return nil
+		}
+		result = report
+	}
+	if s.dedup != nil {
+		if s.dedup.Skip(&result) {
+			s.logger.Debug("reading unchanged, not sending", "co2", result.Co2Concentration)
+			return nil
+		}
+		if err := send(ctx, d.sink, &result); err != nil {
+			return err
+		}
+		s.dedup.Written(&result)
+		return nil
+	}
+	return send(ctx, d.sink, &result)
 }
 
-func main() {
+// initMaxRuntime returns MAX_RUNTIME, after which the process exits cleanly so
+// a supervisor can restart it with fresh state. Zero means no limit.
+func initMaxRuntime() time.Duration {
+	runtimeStr, found := os.LookupEnv("MAX_RUNTIME")
+	if !found || runtimeStr == "" {
+		return 0
+	}
+	maxRuntime, err := time.ParseDuration(runtimeStr)
+	if err != nil {
+		log.Printf("Invalid MAX_RUNTIME value: %v, running without a limit", err)
+		return 0
+	}
+	if maxRuntime < 0 {
+		log.Printf("MAX_RUNTIME must not be negative, running without a limit")
+		return 0
+	}
+	return maxRuntime
+}
+
+// initStartupDelay returns STARTUP_DELAY, how long to wait before the
+// sensor is first opened, for boards where it isn't ready right at boot. It
+// is separate from the warm-up, during which readings are taken but not sent.
+func initStartupDelay() time.Duration {
+	delayStr, found := os.LookupEnv("STARTUP_DELAY")
+	if !found || delayStr == "" {
+		return 0
+	}
+	delay, err := time.ParseDuration(delayStr)
+	if err != nil || delay < 0 {
+		log.Printf("Invalid STARTUP_DELAY value: %q, starting right away", delayStr)
+		return 0
+	}
+	return delay
+}
+
+// initOneshot reports whether to run a single cycle and exit, as requested
+// by --oneshot or ONESHOT.
+func initOneshot(flagSet bool) bool {
+	if flagSet {
+		return true
+	}
+	oneshotStr, found := os.LookupEnv("ONESHOT")
+	if !found {
+		return false
+	}
+	oneshot, err := strconv.ParseBool(oneshotStr)
+	if err != nil {
+		log.Printf("Invalid ONESHOT value: %v, running continuously", err)
+		return false
+	}
+	return oneshot
+}
+
+func runVersionSensor() {
 	c, err := initConn()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer c.Close()
 
+	version, err := readVersion(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(version)
+}
+
+func runCalibrateZero(force bool) {
+	lock := initCalibrationLock()
+	if err := lock.check(time.Now(), force); err != nil {
+		log.Fatal(err)
+	}
+
+	c, err := initConn()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	log.Printf("WARNING: zero calibration assumes the sensor has been in fresh air (~400ppm) for at least 20 minutes")
+	if err := calibrateZero(c); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Zero calibration command sent")
+	if err := lock.record(time.Now()); err != nil {
+		log.Printf("Failed to record calibration time: %v", err)
+	}
+}
+
+func runCalibrateSpan(ppm uint, force bool) {
+	if ppm < minSpanPPM || ppm > maxSpanPPM {
+		log.Fatalf("span calibration ppm must be between %d and %d, got %d", minSpanPPM, maxSpanPPM, ppm)
+	}
+	lock := initCalibrationLock()
+	if err := lock.check(time.Now(), force); err != nil {
+		log.Fatal(err)
+	}
+
+	c, err := initConn()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	log.Printf("WARNING: span calibration assumes the sensor is exposed to a stable %d ppm reference gas", ppm)
+	if err := calibrateSpan(c, uint16(ppm)); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Span calibration command sent (%d ppm)", ppm)
+	if err := lock.record(time.Now()); err != nil {
+		log.Printf("Failed to record calibration time: %v", err)
+	}
+}
+
+func main() {
+	loadEnvFile()
+	initLogger()
+	dispatch(os.Args[1:])
+}
+
+// runDaemon reads the sensors and sends their readings until shut down, or
+// once per sensor with oneshot.
+func runDaemon(oneshot bool) {
+	startTime := time.Now()
+	// exitCode is applied once every deferred cleanup below has run, so
+	// one-shot failures still flush the sink.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+	// SIGUSR1 is caught from the start: its default action would kill the
+	// process while the sink and ports are still being set up.
+	manualReads := make(chan os.Signal, 1)
+	signal.Notify(manualReads, syscall.SIGUSR1)
+	defer signal.Stop(manualReads)
+
 	loc := initLocation()
 	influxInfo, err := initInfo()
 	if err != nil {
 		log.Fatal(err)
 	}
-	client, err := initClient()
+	sink, outputMode, err := initSink(influxInfo, oneshot)
 	if err != nil {
 		log.Fatal(err)
 	}
-	sleepDuration := initSleepDuration()
+	d := &Daemon{
+		sink:        sink,
+		readCfg:     initReadConfig(),
+		retries:     initReadRetries(),
+		loc:         loc,
+		warm:        warmup{start: startTime},
+		interval:    initSleepDuration(),
+		jitter:      initSleepJitter(),
+		history:     newReadingHistory(initHistorySize()),
+		stream:      initStreamMode(),
+		manualReads: manualReads,
+	}
+	// Close flushes any pending writes after the serial ports are closed.
+	defer d.Close()
+	if !oneshot {
+		// A one-shot run never outlives the warm-up, so it is skipped.
+		d.warm.duration = initWarmupDuration()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if maxRuntime := initMaxRuntime(); maxRuntime > 0 && !oneshot {
+		log.Printf("Exiting after MAX_RUNTIME of %v", maxRuntime)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		defer cancel()
+	}
+	replay, err := initReplay()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if replay != nil {
+		d.replay = true
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-replay.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
 
-	cmd := buildCommand()
-	for {
-		go doIt(c, cmd, client, influxInfo, loc)
-		time.Sleep(sleepDuration)
+	admin := initCalibrationAdmin()
+	if !oneshot {
+		srv := startHTTPServer(initHTTPAddr(), initPrometheus(), initHealthMaxAge(d.interval), d, admin)
+		defer shutdownHTTPServer(srv)
+		go logHeartbeat(ctx)
+		go d.runWatchdog(ctx)
+	}
+
+	if delay := initStartupDelay(); delay > 0 {
+		log.Printf("Waiting STARTUP_DELAY of %v before opening the sensor", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	startupRetries := initStartupPortRetries()
+	maxErrors := initMaxConsecutiveErrors()
+	mode := initSerialMode()
+	devices := initUARTDevs()
+	if replay != nil && len(devices) > 0 {
+		log.Fatal("REPLAY_FILE cannot be combined with UART_DEVS")
+	}
+	logEffectiveConfig(effectiveConfig{
+		UARTDevices: devices,
+		SerialMode:  mode,
+		Interval:    d.interval,
+		Info:        influxInfo,
+		Location:    loc,
+		OutputMode:  outputMode,
+	})
+
+	sensorIDs, err := initSensorIDs(devices)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.failOnSelfTest = initFailOnSelfTest()
+	if len(devices) == 0 {
+		open := initConn
+		if replay != nil {
+			open = func() (io.ReadWriteCloser, error) { return replay, nil }
+		}
+		s, err := newSensorLoop(sensorIDs[0], open, startupRetries, maxErrors, influxInfo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.loops = append(d.loops, s)
+	} else {
+		// Each device gets its own port, filter and reconnect state; only
+		// the sink is shared.
+		for i, device := range devices {
+			open := func() (io.ReadWriteCloser, error) { return openConn(device, mode) }
+			s, err := newSensorLoop(sensorIDs[i], open, startupRetries, maxErrors, influxInfo)
+			if err != nil {
+				log.Fatal(err)
+			}
+			d.loops = append(d.loops, s)
+		}
+	}
+
+	if oneshot {
+		if err := d.runOnce(ctx); err != nil {
+			exitCode = 1
+		}
+		return
+	}
+
+	if d.stream {
+		// Frames arrive far more often than the read interval, so
+		// readings are always averaged, by default over one interval.
+		d.reportInterval = initReportInterval(0)
+		if d.reportInterval == 0 {
+			d.reportInterval = d.interval
+		}
+		log.Printf("Streaming mode: reading frames as they arrive, reporting averages every %v", d.reportInterval)
+	} else {
+		d.reportInterval = initReportInterval(d.interval)
+	}
+	for _, s := range d.loops {
+		admin.register(s)
+	}
+	emitEvents := initEmitStartupEvent()
+	if emitEvents {
+		d.emitEvent(ctx, "startup", influxInfo.Tags)
+	}
+	d.run(ctx)
+	if err := sdNotify("STOPPING=1"); err != nil {
+		slog.Error("error sending stopping notification", "error", err)
+	}
+	if emitEvents {
+		// ctx is already cancelled; give the event its own deadline so
+		// it is queued before the sink flushes on Close.
+		eventCtx, cancel := context.WithTimeout(context.Background(), eventShutdownTimeout)
+		d.emitEvent(eventCtx, "shutdown", influxInfo.Tags)
+		cancel()
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("MAX_RUNTIME reached, exiting")
+	} else if replay != nil && replay.finished() {
+		log.Printf("REPLAY_FILE exhausted, exiting")
+	} else {
+		log.Printf("Received shutdown signal, exiting")
 	}
 }
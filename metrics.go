@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are always updated but only registered, and so only exported, when
+// ENABLE_PROMETHEUS is set. Updating an unregistered collector is just an
+// atomic store.
+var (
+	co2Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mhz19c_co2_ppm",
+		Help: "Most recent CO2 concentration in ppm.",
+	})
+	temperatureGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mhz19c_temperature_celsius",
+		Help: "Most recent sensor temperature in degrees Celsius.",
+	})
+	readErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mhz19c_read_errors_total",
+		Help: "Total number of failed sensor read attempts.",
+	})
+	readsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mhz19c_reads_total",
+		Help: "Total number of sensor read attempts.",
+	})
+	rejectedSamplesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mhz19c_rejected_samples_total",
+		Help: "Total number of readings rejected as implausible.",
+	})
+	sensorStuck = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mhz19c_sensor_stuck",
+		Help: "Number of times the sensor returned identical frames for a whole STUCK_WINDOW.",
+	})
+	cyclePanicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mhz19c_cycle_panics_total",
+		Help: "Total number of read cycles aborted by a recovered panic.",
+	})
+	influxWriteSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mhz19c_influx_write_seconds",
+		Help:    "Duration of blocking InfluxDB point writes, including failed ones; with non-blocking writes only the time to queue a point is measured.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+	influxWriteFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mhz19c_influx_write_failures_total",
+		Help: "Total number of failed InfluxDB writes: readings for blocking writes, batches for non-blocking ones, including writes skipped during backoff.",
+	})
+	lastReadUnixtime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mhz19c_last_read_unixtime",
+		Help: "Unix time of the most recent read cycle, successful or not.",
+	})
+	upGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mhz19c_up",
+		Help: "Always 1 while the exporter is running.",
+	})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mhz19c_build_info",
+		Help: "Always 1, labelled with the version and commit of the running build.",
+	}, []string{"version", "commit"})
+)
+
+// heartbeat counts read cycles whether or not they succeed, so a stale
+// lastRead means the loop itself has stopped rather than the sensor failing.
+var heartbeat struct {
+	reads    atomic.Uint64
+	lastRead atomic.Int64
+}
+
+func recordHeartbeat(now time.Time) {
+	heartbeat.reads.Add(1)
+	heartbeat.lastRead.Store(now.Unix())
+	lastReadUnixtime.Set(float64(now.Unix()))
+}
+
+const heartbeatInterval = time.Minute
+
+// logHeartbeat logs the heartbeat every heartbeatInterval until ctx is
+// cancelled.
+func logHeartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			slog.Info("heartbeat", "reads_total", heartbeat.reads.Load(), "last_read_unixtime", heartbeat.lastRead.Load())
+		}
+	}
+}
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func initPrometheus() bool {
+	enabledStr, found := os.LookupEnv("ENABLE_PROMETHEUS")
+	if !found {
+		return false
+	}
+	enabled, err := strconv.ParseBool(enabledStr)
+	if err != nil {
+		log.Printf("Invalid ENABLE_PROMETHEUS value: %v, leaving Prometheus disabled", err)
+		return false
+	}
+	return enabled
+}
+
+// metricsHandler registers the collectors and returns the /metrics handler.
+func metricsHandler() http.Handler {
+	upGauge.Set(1)
+	buildInfo.WithLabelValues(version, commit).Set(1)
+	metricsRegistry.MustRegister(co2Gauge, temperatureGauge, readErrorsTotal, readsTotal, rejectedSamplesTotal, sensorStuck, cyclePanicsTotal, influxWriteSeconds, influxWriteFailuresTotal, lastReadUnixtime, upGauge, buildInfo)
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
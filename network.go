@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Telnet and RFC 2217 (COM-PORT-OPTION) protocol bytes.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptBinary          = 0
+	telnetOptSuppressGoAhead = 3
+	telnetOptComPort         = 44
+
+	comPortSetBaudRate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+)
+
+const netDialTimeout = 10 * time.Second
+
+// isNetworkDevice reports whether device names a network serial server
+// rather than a local port.
+func isNetworkDevice(device string) bool {
+	return strings.HasPrefix(device, "tcp://") || strings.HasPrefix(device, "rfc2217://")
+}
+
+// openNetConn connects to a serial server such as ser2net. tcp:// is a raw
+// byte passthrough; rfc2217:// speaks telnet and configures the remote port
+// to match mode.
+func openNetConn(device string, mode *serial.Mode, timeout time.Duration) (*netPort, error) {
+	scheme, addr, _ := strings.Cut(device, "://")
+	conn, err := net.DialTimeout("tcp", addr, netDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", device, err)
+	}
+	p := &netPort{conn: conn, timeout: timeout, telnet: scheme == "rfc2217"}
+	if p.telnet {
+		if err := p.negotiate(mode); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to negotiate RFC 2217 with %s: %v", device, err)
+		}
+	}
+	return p, nil
+}
+
+// netPort adapts a TCP connection to the behavior read expects from a serial
+// port: a Read that times out returns 0, nil instead of an error. In telnet
+// mode it also escapes outgoing 0xFF bytes and strips telnet commands from
+// the incoming stream.
+type netPort struct {
+	conn    net.Conn
+	timeout time.Duration
+	telnet  bool
+
+	// telnet decoder state carried across reads
+	state int
+	verb  byte
+}
+
+const (
+	telnetData = iota
+	telnetGotIAC
+	telnetGotVerb
+	telnetSubneg
+	telnetSubnegIAC
+)
+
+func (p *netPort) negotiate(mode *serial.Mode) error {
+	msg := []byte{telnetIAC, telnetWILL, telnetOptComPort}
+	baud := uint32(mode.BaudRate)
+	msg = append(msg, comPortSubneg(comPortSetBaudRate, byte(baud>>24), byte(baud>>16), byte(baud>>8), byte(baud))...)
+	msg = append(msg, comPortSubneg(comPortSetDataSize, byte(mode.DataBits))...)
+	msg = append(msg, comPortSubneg(comPortSetParity, rfc2217Parity(mode.Parity))...)
+	msg = append(msg, comPortSubneg(comPortSetStopSize, rfc2217StopBits(mode.StopBits))...)
+	_, err := p.conn.Write(msg)
+	return err
+}
+
+func comPortSubneg(command byte, value ...byte) []byte {
+	msg := []byte{telnetIAC, telnetSB, telnetOptComPort, command}
+	msg = append(msg, escapeIAC(value)...)
+	return append(msg, telnetIAC, telnetSE)
+}
+
+func rfc2217Parity(parity serial.Parity) byte {
+	switch parity {
+	case serial.OddParity:
+		return 2
+	case serial.EvenParity:
+		return 3
+	case serial.MarkParity:
+		return 4
+	case serial.SpaceParity:
+		return 5
+	default:
+		return 1
+	}
+}
+
+func rfc2217StopBits(stopBits serial.StopBits) byte {
+	switch stopBits {
+	case serial.TwoStopBits:
+		return 2
+	case serial.OnePointFiveStopBits:
+		return 3
+	default:
+		return 1
+	}
+}
+
+func escapeIAC(b []byte) []byte {
+	escaped := make([]byte, 0, len(b))
+	for _, c := range b {
+		escaped = append(escaped, c)
+		if c == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+	}
+	return escaped
+}
+
+func (p *netPort) Write(b []byte) (int, error) {
+	data := b
+	if p.telnet {
+		data = escapeIAC(b)
+	}
+	if _, err := p.conn.Write(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *netPort) Read(b []byte) (int, error) {
+	if err := p.conn.SetReadDeadline(time.Now().Add(p.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := p.conn.Read(b)
+	if p.telnet {
+		n = p.decode(b[:n])
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return n, nil
+	}
+	return n, err
+}
+
+// decode strips telnet commands from b in place, answering option requests,
+// and returns the number of data bytes left.
+func (p *netPort) decode(b []byte) int {
+	n := 0
+	for _, c := range b {
+		switch p.state {
+		case telnetData:
+			if c == telnetIAC {
+				p.state = telnetGotIAC
+				continue
+			}
+			b[n] = c
+			n++
+		case telnetGotIAC:
+			switch c {
+			case telnetIAC:
+				b[n] = c
+				n++
+				p.state = telnetData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				p.verb = c
+				p.state = telnetGotVerb
+			case telnetSB:
+				p.state = telnetSubneg
+			default:
+				p.state = telnetData
+			}
+		case telnetGotVerb:
+			p.answerOption(p.verb, c)
+			p.state = telnetData
+		case telnetSubneg:
+			// Subnegotiation replies (e.g. COM-PORT acknowledgements) are
+			// ignored.
+			if c == telnetIAC {
+				p.state = telnetSubnegIAC
+			}
+		case telnetSubnegIAC:
+			if c == telnetSE {
+				p.state = telnetData
+			} else {
+				p.state = telnetSubneg
+			}
+		}
+	}
+	return n
+}
+
+// answerOption accepts the options needed for a clean 8-bit stream and
+// refuses everything else.
+func (p *netPort) answerOption(verb, option byte) {
+	supported := option == telnetOptBinary || option == telnetOptSuppressGoAhead || option == telnetOptComPort
+	var reply byte
+	switch verb {
+	case telnetDO:
+		if option == telnetOptComPort {
+			return // answer to our own WILL
+		}
+		reply = telnetWONT
+		if supported {
+			reply = telnetWILL
+		}
+	case telnetWILL:
+		reply = telnetDONT
+		if supported {
+			reply = telnetDO
+		}
+	default:
+		return
+	}
+	// Best effort; a failed write surfaces on the next command anyway.
+	p.conn.Write([]byte{telnetIAC, reply, option})
+}
+
+func (p *netPort) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	outputInfluxDB = "influxdb"
+	outputStdout   = "stdout"
+	outputCSV      = "csv"
+	// outputLineProtocol appends line protocol to LP_FILE for later replay
+	// with "influx write".
+	outputLineProtocol = "lineprotocol"
+)
+
+func initOutputMode() string {
+	mode, found := os.LookupEnv("OUTPUT_MODE")
+	if !found || mode == "" {
+		return outputInfluxDB
+	}
+	switch mode {
+	case outputInfluxDB, outputStdout, outputCSV, outputLineProtocol:
+		return mode
+	default:
+		log.Printf("Invalid OUTPUT_MODE value: %q, defaulting to %s", mode, outputInfluxDB)
+		return outputInfluxDB
+	}
+}
+
+// timestampFormat is used by the text outputs.
+const timestampFormat = time.RFC3339
+
+// stdoutSink prints each reading as "timestamp field=value ..." instead of
+// writing it to InfluxDB, for checking sensor wiring without a database.
+type stdoutSink struct {
+	mu       sync.Mutex
+	out      io.Writer
+	co2Field string
+}
+
+func newStdoutSink(co2Field string) *stdoutSink {
+	return &stdoutSink{out: os.Stdout, co2Field: co2Field}
+}
+
+func (s *stdoutSink) Write(_ context.Context, result *Result) error {
+	fields := resultFields(result, s.co2Field)
+	var sb strings.Builder
+	sb.WriteString(result.Time.Format(timestampFormat))
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		fmt.Fprintf(&sb, " %s=%v", key, fields[key])
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := fmt.Fprintln(s.out, sb.String()); err != nil {
+		return fmt.Errorf("failed to write to stdout: %v", err)
+	}
+	return nil
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
+
+// csvSyncInterval bounds how much CSV data can be lost on a crash.
+const csvSyncInterval = time.Minute
+
+// csvSink appends one "timestamp,co2_ppm,temperature_c" row per reading to a
+// file that stays open for the lifetime of the process.
+type csvSink struct {
+	mu       sync.Mutex
+	file     *os.File
+	csv      *csv.Writer
+	lastSync time.Time
+}
+
+func newCSVSink(path string) (*csvSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CSV_FILE %s: %v", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat CSV_FILE %s: %v", path, err)
+	}
+	w := &csvSink{file: file, csv: csv.NewWriter(file), lastSync: time.Now()}
+	if info.Size() == 0 {
+		if err := w.writeRow([]string{"timestamp", "co2_ppm", "temperature_c"}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *csvSink) Write(_ context.Context, result *Result) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	row := []string{
+		result.Time.Format(timestampFormat),
+		fmt.Sprint(result.Co2Concentration),
+		"",
+	}
+	if !result.NoTemperature {
+		row[2] = fmt.Sprint(result.Temperature)
+	}
+	if err := w.writeRow(row); err != nil {
+		return err
+	}
+	if time.Since(w.lastSync) >= csvSyncInterval {
+		return w.syncLocked()
+	}
+	return nil
+}
+
+func (w *csvSink) writeRow(row []string) error {
+	if err := w.csv.Write(row); err != nil {
+		return fmt.Errorf("failed to write CSV row: %v", err)
+	}
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV row: %v", err)
+	}
+	return nil
+}
+
+func (w *csvSink) syncLocked() error {
+	w.lastSync = time.Now()
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync CSV file: %v", err)
+	}
+	return nil
+}
+
+// Close syncs and closes the file.
+func (w *csvSink) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.syncLocked(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func initCSVFile() (string, error) {
+	path, found := os.LookupEnv("CSV_FILE")
+	if !found || path == "" {
+		return "", fmt.Errorf("CSV_FILE not set (required when OUTPUT_MODE=csv)")
+	}
+	return path, nil
+}
+
+const defaultLPMaxBytes = 10 * 1024 * 1024
+
+// lineProtocolSink appends each reading as a line-protocol record. Once the
+// file reaches maxBytes it is rotated to path.1, replacing any earlier
+// rotation, so at most about twice maxBytes is kept on disk.
+type lineProtocolSink struct {
+	mu          sync.Mutex
+	path        string
+	maxBytes    int64
+	measurement string
+	// temperatureMeasurement is as in influxSink.
+	temperatureMeasurement string
+	co2Field               string
+	precision              time.Duration
+	file                   *os.File
+	size                   int64
+}
+
+func initLineProtocolSink(info InfluxDBInfo, co2Field string) (*lineProtocolSink, error) {
+	path, found := os.LookupEnv("LP_FILE")
+	if !found || path == "" {
+		return nil, fmt.Errorf("LP_FILE not set (required when OUTPUT_MODE=lineprotocol)")
+	}
+	maxBytes := int64(defaultLPMaxBytes)
+	if maxStr, found := os.LookupEnv("LP_MAX_BYTES"); found {
+		parsed, err := strconv.ParseInt(maxStr, 10, 64)
+		if err != nil || parsed <= 0 {
+			log.Printf("Invalid LP_MAX_BYTES value: %q, defaulting to %d", maxStr, defaultLPMaxBytes)
+		} else {
+			maxBytes = parsed
+		}
+	}
+	precision, err := initPrecision()
+	if err != nil {
+		return nil, err
+	}
+	s := &lineProtocolSink{
+		path:                   path,
+		maxBytes:               maxBytes,
+		measurement:            info.Measurement,
+		temperatureMeasurement: info.TemperatureMeasurement,
+		co2Field:               co2Field,
+		precision:              precision,
+	}
+	if err := s.openLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *lineProtocolSink) openLocked() error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open LP_FILE %s: %v", s.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat LP_FILE %s: %v", s.path, err)
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *lineProtocolSink) Write(ctx context.Context, result *Result) error {
+	return s.WritePoint(ctx, newResultPoints(s.measurement, s.temperatureMeasurement, s.co2Field, result)...)
+}
+
+// WritePoint appends points as they are, for points other than readings.
+func (s *lineProtocolSink) WritePoint(_ context.Context, points ...*write.Point) error {
+	var sb strings.Builder
+	for _, point := range points {
+		sb.WriteString(write.PointToLineProtocol(point, s.precision))
+	}
+	line := sb.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.WriteString(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to append to LP_FILE %s: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s *lineProtocolSink) rotateLocked() error {
+	if err := s.file.Close(); err != nil {
+		slog.Warn("error closing line protocol file before rotation", "error", err)
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		// Keep appending to the oversized file rather than losing readings.
+		slog.Error("failed to rotate line protocol file", "path", s.path, "error", err)
+		return s.openLocked()
+	}
+	log.Printf("Rotated %s to %s.1", s.path, s.path)
+	return s.openLocked()
+}
+
+func (s *lineProtocolSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
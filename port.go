@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const (
+	reconnectBaseBackoff       = 1 * time.Second
+	defaultReconnectMaxBackoff = 30 * time.Second
+)
+
+// initReconnectMaxBackoff returns RECONNECT_MAX_BACKOFF, the cap on the delay
+// between reconnect attempts.
+func initReconnectMaxBackoff() time.Duration {
+	maxStr, found := os.LookupEnv("RECONNECT_MAX_BACKOFF")
+	if !found || maxStr == "" {
+		return defaultReconnectMaxBackoff
+	}
+	maxBackoff, err := time.ParseDuration(maxStr)
+	if err != nil {
+		log.Printf("Invalid RECONNECT_MAX_BACKOFF value: %v, defaulting to %v", err, defaultReconnectMaxBackoff)
+		return defaultReconnectMaxBackoff
+	}
+	if maxBackoff < reconnectBaseBackoff {
+		log.Printf("RECONNECT_MAX_BACKOFF must be at least %v, defaulting to %v", reconnectBaseBackoff, defaultReconnectMaxBackoff)
+		return defaultReconnectMaxBackoff
+	}
+	return maxBackoff
+}
+
+// sensorPort owns the serial connection of one sensor loop. After maxErrors
+// consecutive I/O failures it closes the connection and reopens it with open,
+// so callers always go through the current handle.
+type sensorPort struct {
+	conn              io.ReadWriteCloser
+	open              func() (io.ReadWriteCloser, error)
+	consecutiveErrors int
+	maxErrors         int
+
+	// backoff is the base delay before the next reconnect attempt. It keeps
+	// growing across reconnects until a read succeeds.
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newSensorPort(conn io.ReadWriteCloser, open func() (io.ReadWriteCloser, error), maxErrors int) *sensorPort {
+	return &sensorPort{
+		conn:       conn,
+		open:       open,
+		maxErrors:  maxErrors,
+		backoff:    reconnectBaseBackoff,
+		maxBackoff: initReconnectMaxBackoff(),
+	}
+}
+
+func (p *sensorPort) Read(b []byte) (int, error) {
+	return p.conn.Read(b)
+}
+
+func (p *sensorPort) Write(b []byte) (int, error) {
+	return p.conn.Write(b)
+}
+
+func (p *sensorPort) Close() error {
+	return p.conn.Close()
+}
+
+// ResetInputBuffer flushes the current connection's input, if it supports
+// doing so.
+func (p *sensorPort) ResetInputBuffer() error {
+	if r, ok := p.conn.(inputResetter); ok {
+		return r.ResetInputBuffer()
+	}
+	return nil
+}
+
+// recordSuccess resets the consecutive error count and the reconnect
+// backoff.
+func (p *sensorPort) recordSuccess() {
+	p.consecutiveErrors = 0
+	p.backoff = reconnectBaseBackoff
+}
+
+// recordError counts a failed cycle and reconnects once the threshold is
+// reached. It blocks until the port is reopened or ctx is cancelled.
+func (p *sensorPort) recordError(ctx context.Context) {
+	p.consecutiveErrors++
+	if p.consecutiveErrors < p.maxErrors {
+		return
+	}
+	slog.Warn("consecutive read errors, reconnecting serial port", "errors", p.consecutiveErrors)
+	p.reconnect(ctx)
+}
+
+func (p *sensorPort) reconnect(ctx context.Context) {
+	if err := p.conn.Close(); err != nil {
+		slog.Warn("error closing serial port", "error", err)
+	}
+	for attempt := 1; ; attempt++ {
+		// A loop stuck reconnecting is still making progress as far as
+		// the watchdog is concerned.
+		recordHeartbeat(time.Now())
+		slog.Warn("reconnecting serial port", "attempt", attempt)
+		conn, err := p.open()
+		if err == nil {
+			slog.Warn("reconnected serial port", "attempts", attempt)
+			p.conn = conn
+			p.consecutiveErrors = 0
+			return
+		}
+		delay := p.nextBackoff()
+		slog.Warn("reconnect attempt failed", "attempt", attempt, "error", err, "retry_in", delay.String())
+		select {
+		case <-ctx.Done():
+			// Leave a closed handle in place; the caller is shutting down.
+			p.conn = closedConn{}
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// nextBackoff returns the current backoff plus up to 50% random jitter,
+// capped at maxBackoff, and doubles the backoff for the next attempt. The
+// jitter keeps a fleet that lost a shared resource from reconnecting in
+// lockstep.
+func (p *sensorPort) nextBackoff() time.Duration {
+	delay := p.backoff + time.Duration(rand.Int63n(int64(p.backoff/2)+1))
+	p.backoff = min(p.backoff*2, p.maxBackoff)
+	return min(delay, p.maxBackoff)
+}
+
+// closedConn stands in for a port that could not be reopened before shutdown.
+type closedConn struct{}
+
+func (closedConn) Read([]byte) (int, error)  { return 0, io.ErrClosedPipe }
+func (closedConn) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
+func (closedConn) Close() error              { return nil }
+
+func initMaxConsecutiveErrors() int {
+	maxStr, found := os.LookupEnv("MAX_CONSECUTIVE_ERRORS")
+	if !found {
+		maxStr = "5"
+	}
+	maxErrors, err := strconv.Atoi(maxStr)
+	if err != nil {
+		log.Printf("Invalid MAX_CONSECUTIVE_ERRORS value: %v, defaulting to 5", err)
+		maxErrors = 5
+	}
+	if maxErrors <= 0 {
+		log.Printf("MAX_CONSECUTIVE_ERRORS must be positive, defaulting to 5")
+		maxErrors = 5
+	}
+	return maxErrors
+}
+
+func initAutodetect() bool {
+	autodetectStr, found := os.LookupEnv("UART_AUTODETECT")
+	if !found {
+		return false
+	}
+	autodetect, err := strconv.ParseBool(autodetectStr)
+	if err != nil {
+		log.Printf("Invalid UART_AUTODETECT value: %v, disabling autodetection", err)
+		return false
+	}
+	return autodetect
+}
+
+// probeReadConfig is the read configuration used when probing ports, which
+// must not depend on settings meant for the port finally chosen.
+var probeReadConfig = readConfig{CommandDelay: defaultCommandDelay, MaxPPM: defaultMaxPPM, ReadTimeout: defaultReadTimeout}
+
+// detectSensorPort sends a read command to each port and returns the first
+// one answering with a valid frame. Probing writes to every listed device, so
+// it only runs when UART_AUTODETECT is enabled.
+func detectSensorPort(ports []string, mode *serial.Mode) (string, bool) {
+	for _, name := range ports {
+		if probePort(name, mode, probeReadConfig) {
+			log.Printf("Detected MH-Z19C on %s", name)
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func probePort(name string, mode *serial.Mode, cfg readConfig) bool {
+	p, err := serial.Open(name, mode)
+	if err != nil {
+		slog.Debug("probe: failed to open port", "port", name, "error", err)
+		return false
+	}
+	defer p.Close()
+	if err := p.SetReadTimeout(cfg.ReadTimeout); err != nil {
+		slog.Debug("probe: failed to set read timeout", "port", name, "error", err)
+		return false
+	}
+	if err := selfTest(p, cfg, 1); err != nil {
+		slog.Debug("probe: no valid response", "port", name, "error", err)
+		return false
+	}
+	return true
+}
+
+// selfTestAttempts is how many reads the startup self-test tries before
+// giving up.
+const selfTestAttempts = 3
+
+// selfTest issues up to attempts reads and checks that the sensor answers with
+// a well-formed frame. An out-of-range value (e.g. during warm-up) still
+// counts as a response. If no attempt received a single byte the returned
+// error wraps errNoResponse.
+func selfTest(dev io.ReadWriter, cfg readConfig, attempts int) error {
+	var err error
+	silent := true
+	for i := 0; i < attempts; i++ {
+		_, err = read(dev, buildCommand(), cfg)
+		if err == nil || errors.Is(err, errImplausibleConcentration) {
+			return nil
+		}
+		if !errors.Is(err, errNoResponse) {
+			silent = false
+		}
+	}
+	if silent {
+		return fmt.Errorf("self-test failed after %d attempts: %w", attempts, errNoResponse)
+	}
+	return fmt.Errorf("self-test failed: %v", err)
+}
+
+func initFailOnSelfTest() bool {
+	failStr, found := os.LookupEnv("FAIL_ON_SELFTEST")
+	if !found {
+		return false
+	}
+	fail, err := strconv.ParseBool(failStr)
+	if err != nil {
+		log.Printf("Invalid FAIL_ON_SELFTEST value: %v, defaulting to false", err)
+		return false
+	}
+	return fail
+}
+
+func initStartupPortRetries() int {
+	retriesStr, found := os.LookupEnv("STARTUP_PORT_RETRIES")
+	if !found {
+		return 0
+	}
+	retries, err := strconv.Atoi(retriesStr)
+	if err != nil {
+		log.Printf("Invalid STARTUP_PORT_RETRIES value: %v, defaulting to 0", err)
+		return 0
+	}
+	if retries < 0 {
+		log.Printf("STARTUP_PORT_RETRIES must not be negative, defaulting to 0")
+		return 0
+	}
+	return retries
+}
+
+// openWithRetry calls open, retrying up to retries more times with
+// exponential backoff so a USB adapter that enumerates late at boot is
+// picked up rather than fatal.
+func openWithRetry(open func() (io.ReadWriteCloser, error), retries int) (io.ReadWriteCloser, error) {
+	backoff := reconnectBaseBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := open()
+		if err == nil || attempt >= retries {
+			return conn, err
+		}
+		log.Printf("Failed to open serial port (attempt %d/%d): %v, retrying in %v", attempt+1, retries+1, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, defaultReconnectMaxBackoff)
+	}
+}
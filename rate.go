@@ -0,0 +1,31 @@
+package main
+
+import "time"
+
+// rateTracker computes the CO2 rate of change between consecutive readings
+// of one sensor.
+type rateTracker struct {
+	// maxGap is the longest elapsed time over which a rate is still
+	// reported; longer gaps (missed reads, restarts) would average over too
+	// much to be meaningful.
+	maxGap time.Duration
+
+	last    time.Time
+	lastCo2 float32
+}
+
+// Observe records co2 measured at t and returns the rate in ppm per minute
+// since the previous reading. ok is false for the first reading and after a
+// gap longer than maxGap.
+func (r *rateTracker) Observe(co2 float32, t time.Time) (rate float32, ok bool) {
+	prev, prevCo2 := r.last, r.lastCo2
+	r.last, r.lastCo2 = t, co2
+	if prev.IsZero() {
+		return 0, false
+	}
+	elapsed := t.Sub(prev)
+	if elapsed <= 0 || elapsed > r.maxGap {
+		return 0, false
+	}
+	return (co2 - prevCo2) / float32(elapsed.Minutes()), true
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSerial stands in for the sensor. Each Write records the command and
+// stages response to be returned by subsequent Reads. Once the staged bytes
+// are exhausted Read behaves like a serial port hitting its read timeout.
+type fakeSerial struct {
+	response []byte
+	written  [][]byte
+	pending  []byte
+}
+
+func (f *fakeSerial) Write(b []byte) (int, error) {
+	f.written = append(f.written, append([]byte(nil), b...))
+	f.pending = append(f.pending, f.response...)
+	return len(b), nil
+}
+
+func (f *fakeSerial) Read(b []byte) (int, error) {
+	if len(f.pending) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		return 0, nil
+	}
+	n := copy(b, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// newTestDaemon returns a Daemon with a single sensor loop reading port and
+// writing to sink, with the warm-up off. Tests adjust its fields as needed.
+func newTestDaemon(t *testing.T, port io.ReadWriteCloser, sink Sink) *Daemon {
+	t.Helper()
+	s, err := newSensorLoop("", func() (io.ReadWriteCloser, error) { return port, nil }, 0, 100, InfluxDBInfo{})
+	if err != nil {
+		t.Fatalf("newSensorLoop returned error: %v", err)
+	}
+	return &Daemon{
+		loops:    []*sensorLoop{s},
+		sink:     sink,
+		readCfg:  testReadConfig,
+		retries:  1,
+		loc:      time.UTC,
+		interval: time.Minute,
+		history:  newReadingHistory(10),
+	}
+}
+
+// frame builds a read response carrying ppm and temperature (in Celsius).
+func frame(ppm int, temperature int) []byte {
+	response := []byte{0xFF, 0x86, byte(ppm / 256), byte(ppm % 256), byte(temperature + 40), 0x00, 0x00, 0x00, 0x00}
+	response[8] = checksum(response)
+	return response
+}
+
+var testReadConfig = readConfig{MaxPPM: defaultMaxPPM, ReadTimeout: 100 * time.Millisecond}
+
+func TestReadValidFrame(t *testing.T) {
+	dev := &fakeSerial{response: frame(812, 24)}
+	cmd := buildCommand()
+
+	result, err := read(dev, cmd, testReadConfig)
+	if err != nil {
+		t.Fatalf("read returned error: %v", err)
+	}
+	if result.Co2Concentration != 812 {
+		t.Errorf("Co2Concentration = %v, want 812", result.Co2Concentration)
+	}
+	if result.Temperature != 24 {
+		t.Errorf("Temperature = %v, want 24", result.Temperature)
+	}
+	if len(dev.written) != 1 || !bytes.Equal(dev.written[0], cmd) {
+		t.Errorf("written = % X, want one write of % X", dev.written, cmd)
+	}
+}
+
+func TestReadBadHeader(t *testing.T) {
+	response := frame(812, 24)
+	response[1] = 0x87
+	dev := &fakeSerial{response: response}
+
+	_, err := read(dev, buildCommand(), testReadConfig)
+	if err == nil || !strings.Contains(err.Error(), "frame desync") {
+		t.Fatalf("read error = %v, want frame desync", err)
+	}
+}
+
+func TestReadEchoTracksCommand(t *testing.T) {
+	response := frame(812, 24)
+	response[1] = 0x85
+	response[8] = checksum(response)
+	cmd := newCommand(0x85)
+	cmd[8] = checksum(cmd)
+	dev := &fakeSerial{response: response}
+
+	result, err := read(dev, cmd, testReadConfig)
+	if err != nil {
+		t.Fatalf("read returned error: %v", err)
+	}
+	if result.Co2Concentration != 812 {
+		t.Errorf("Co2Concentration = %v, want 812", result.Co2Concentration)
+	}
+}
+
+func TestReadBadChecksum(t *testing.T) {
+	response := frame(812, 24)
+	response[8]++
+	dev := &fakeSerial{response: response}
+
+	_, err := read(dev, buildCommand(), testReadConfig)
+	if err == nil || !strings.Contains(err.Error(), "invalid checksum") {
+		t.Fatalf("read error = %v, want invalid checksum", err)
+	}
+}
+
+func TestReadChecksumModes(t *testing.T) {
+	response := frame(812, 24)
+	response[8]++
+	for _, mode := range []string{checksumWarn, checksumIgnore} {
+		cfg := testReadConfig
+		cfg.ChecksumMode = mode
+		dev := &fakeSerial{response: response}
+
+		result, err := read(dev, buildCommand(), cfg)
+		if err != nil {
+			t.Errorf("read with CHECKSUM_MODE=%s returned error: %v", mode, err)
+			continue
+		}
+		if result.Co2Concentration != 812 {
+			t.Errorf("read with CHECKSUM_MODE=%s: Co2Concentration = %v, want 812", mode, result.Co2Concentration)
+		}
+	}
+}
+
+func TestReadLogsChecksumOK(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	bad := frame(812, 24)
+	bad[8]++
+	cfg := testReadConfig
+	cfg.ChecksumMode = checksumIgnore
+	for _, tt := range []struct {
+		response []byte
+		want     string
+	}{
+		{frame(812, 24), "checksum_ok=true"},
+		{bad, "checksum_ok=false"},
+	} {
+		logs.Reset()
+		if _, err := read(&fakeSerial{response: tt.response}, buildCommand(), cfg); err != nil {
+			t.Fatalf("read returned error: %v", err)
+		}
+		if line := logs.String(); !strings.Contains(line, `msg="received response"`) || !strings.Contains(line, tt.want) {
+			t.Errorf("debug log = %q, want received response with %s", line, tt.want)
+		}
+	}
+}
+
+func TestChecksumReporter(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// A clone whose checksum is always one too high, then one that omits it.
+	var c checksumReporter
+	steps := []struct {
+		received, computed byte
+		want               string
+	}{
+		{0x11, 0x10, "received=11 computed=10"},
+		{0x21, 0x20, ""},
+		{0x00, 0x30, "received=00 computed=30"},
+		{0x00, 0x31, ""},
+		{0x41, 0x41, "msg=\"checksum matches\""},
+	}
+	for i, step := range steps {
+		logs.Reset()
+		c.report(checksumWarn, step.received, step.computed)
+		if got := logs.String(); step.want == "" && got != "" {
+			t.Errorf("step %d logged %q, want nothing for an unchanged difference", i, got)
+		} else if !strings.Contains(got, step.want) {
+			t.Errorf("step %d logged %q, want %s", i, got, step.want)
+		}
+	}
+}
+
+func TestReadShortFrame(t *testing.T) {
+	dev := &fakeSerial{response: frame(812, 24)[:5]}
+
+	_, err := read(dev, buildCommand(), testReadConfig)
+	if !errors.Is(err, errReadTimeout) {
+		t.Fatalf("read error = %v, want errReadTimeout", err)
+	}
+}
+
+func TestReadStreamedResyncs(t *testing.T) {
+	dev := &fakeSerial{pending: append([]byte{0x12, 0x34}, frame(812, 24)...)}
+
+	result, err := readStreamed(dev, testReadConfig)
+	if err != nil {
+		t.Fatalf("readStreamed returned error: %v", err)
+	}
+	if result.Co2Concentration != 812 {
+		t.Errorf("Co2Concentration = %v, want 812", result.Co2Concentration)
+	}
+	if len(dev.written) != 0 {
+		t.Errorf("readStreamed wrote % X, want no commands", dev.written)
+	}
+}
+
+func TestSelfTestDiagnosis(t *testing.T) {
+	silent := &fakeSerial{}
+	err := selfTest(silent, testReadConfig, 2)
+	if !errors.Is(err, errNoResponse) {
+		t.Errorf("selfTest(silent) error = %v, want errNoResponse", err)
+	}
+	if len(silent.written) != 2 {
+		t.Errorf("selfTest(silent) sent %d commands, want 2", len(silent.written))
+	}
+
+	partial := &fakeSerial{response: frame(812, 24)[:5]}
+	err = selfTest(partial, testReadConfig, 2)
+	if err == nil || errors.Is(err, errNoResponse) {
+		t.Errorf("selfTest(partial) error = %v, want a non-silent failure", err)
+	}
+
+	if err := selfTest(&fakeSerial{response: frame(812, 24)}, testReadConfig, 2); err != nil {
+		t.Errorf("selfTest(valid) error = %v", err)
+	}
+}
+
+func TestReadImplausibleConcentration(t *testing.T) {
+	for _, ppm := range []int{0, 65535} {
+		dev := &fakeSerial{response: frame(ppm, 24)}
+
+		_, err := read(dev, buildCommand(), testReadConfig)
+		if !errors.Is(err, errImplausibleConcentration) {
+			t.Errorf("read(%d ppm) error = %v, want errImplausibleConcentration", ppm, err)
+		}
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	unclamped := frame(5000, 30)
+	unclamped[6], unclamped[7] = 0x1B, 0x58 // 7000 ppm
+	unclamped[8] = checksum(unclamped)
+
+	badHeader := frame(812, 24)
+	badHeader[0] = 0x00
+	badChecksum := frame(812, 24)
+	badChecksum[8]++
+
+	tests := []struct {
+		name          string
+		response      []byte
+		co2           float32
+		temperature   float32
+		rawCo2        float32
+		noTemperature bool
+		wantErr       string
+	}{
+		{name: "valid", response: frame(812, 24), co2: 812, temperature: 24},
+		{name: "negative temperature", response: frame(450, -5), co2: 450, temperature: -5},
+		{name: "unclamped value", response: unclamped, co2: 5000, temperature: 30, rawCo2: 7000},
+		{name: "no temperature", response: frame(812, -40), co2: 812, temperature: -40, noTemperature: true},
+		{name: "bad header", response: badHeader, wantErr: "invalid response header"},
+		{name: "bad checksum", response: badChecksum, wantErr: "invalid checksum"},
+		{name: "short", response: frame(812, 24)[:8], wantErr: "invalid response length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseResponse(tt.response)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseResponse error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseResponse returned error: %v", err)
+			}
+			if result.Co2Concentration != tt.co2 || result.Temperature != tt.temperature || result.RawCo2 != tt.rawCo2 {
+				t.Errorf("parseResponse = {co2 %v, temperature %v, raw %v}, want {%v, %v, %v}",
+					result.Co2Concentration, result.Temperature, result.RawCo2, tt.co2, tt.temperature, tt.rawCo2)
+			}
+			if result.NoTemperature != tt.noTemperature {
+				t.Errorf("NoTemperature = %v, want %v", result.NoTemperature, tt.noTemperature)
+			}
+			if !bytes.Equal(result.Frame[:], tt.response) {
+				t.Errorf("Frame = % X, want % X", result.Frame, tt.response)
+			}
+		})
+	}
+}
+
+func TestReadVersion(t *testing.T) {
+	response := []byte{0xFF, 0xA0, '0', '4', '4', '3', 0x00, 0x00, 0x00}
+	response[8] = checksum(response)
+	dev := &fakeSerial{response: response}
+
+	version, err := readVersion(dev)
+	if err != nil {
+		t.Fatalf("readVersion returned error: %v", err)
+	}
+	if version != "0443" {
+		t.Errorf("version = %q, want 0443", version)
+	}
+
+	_, err = readVersion(&fakeSerial{})
+	if !errors.Is(err, errVersionNotSupported) {
+		t.Errorf("readVersion on a silent sensor: error = %v, want errVersionNotSupported", err)
+	}
+}
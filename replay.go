@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errReplayFinished is returned once every recorded frame has been replayed
+// and REPLAY_LOOP is off.
+var errReplayFinished = errors.New("replay finished")
+
+// replayPort stands in for the sensor with frames recorded in a file. Each
+// read command written to it stages the next frame; other commands get no
+// answer, as with a sensor that doesn't implement them.
+type replayPort struct {
+	mu      sync.Mutex
+	frames  [][]byte
+	next    int
+	loop    bool
+	pending []byte
+	done    chan struct{}
+}
+
+func newReplayPort(frames [][]byte, loop bool) *replayPort {
+	return &replayPort{frames: frames, loop: loop, done: make(chan struct{})}
+}
+
+func (p *replayPort) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(b) < 3 || b[2] != cmdRead {
+		return len(b), nil
+	}
+	if p.next == len(p.frames) {
+		if !p.loop {
+			if !p.finished() {
+				close(p.done)
+			}
+			return 0, errReplayFinished
+		}
+		p.next = 0
+	}
+	p.pending = append(p.pending, p.frames[p.next]...)
+	p.next++
+	return len(b), nil
+}
+
+// Read behaves like a serial port hitting its read timeout once the staged
+// bytes are exhausted.
+func (p *replayPort) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	p.mu.Unlock()
+	if n == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return n, nil
+}
+
+func (p *replayPort) ResetInputBuffer() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = nil
+	return nil
+}
+
+// Close does nothing, so a reconnect carries on where the replay was
+// instead of starting over.
+func (p *replayPort) Close() error {
+	return nil
+}
+
+// Done is closed when the replay has run out of frames.
+func (p *replayPort) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *replayPort) finished() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseReplayFrames reads one hex-encoded frame per line, e.g.
+// "ff 86 03 2c 40 00 00 00 0b". Spaces are optional; blank lines and lines
+// starting with # are skipped. Frames need not be valid, so recordings of
+// misbehaving sensors can be replayed too.
+func parseReplayFrames(r io.Reader) ([][]byte, error) {
+	var frames [][]byte
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		frame, err := hex.DecodeString(strings.Join(strings.Fields(line), ""))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		frames = append(frames, frame)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no frames found")
+	}
+	return frames, nil
+}
+
+// initReplay returns nil unless REPLAY_FILE is set, in which case the single
+// sensor is replaced by the recorded frames in that file. With REPLAY_LOOP
+// the frames repeat forever; otherwise the run stops after the last one.
+func initReplay() (*replayPort, error) {
+	path := os.Getenv("REPLAY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open REPLAY_FILE: %v", err)
+	}
+	defer f.Close()
+	frames, err := parseReplayFrames(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse REPLAY_FILE %s: %v", path, err)
+	}
+	loop := false
+	if loopStr, found := os.LookupEnv("REPLAY_LOOP"); found {
+		loop, err = strconv.ParseBool(loopStr)
+		if err != nil {
+			log.Printf("Invalid REPLAY_LOOP value: %v, stopping after the last frame", err)
+		}
+	}
+	log.Printf("Replaying %d frame(s) from %s instead of reading the sensor (loop: %v)", len(frames), path, loop)
+	return newReplayPort(frames, loop), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingSink keeps every reading written to it.
+type recordingSink struct {
+	mu      sync.Mutex
+	results []Result
+}
+
+func (s *recordingSink) Write(_ context.Context, result *Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, *result)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestParseReplayFrames(t *testing.T) {
+	input := fmt.Sprintf("# recorded\n% x\n\n%x\n", frame(812, 24), frame(900, 25))
+	frames, err := parseReplayFrames(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseReplayFrames returned error: %v", err)
+	}
+	if len(frames) != 2 || string(frames[1]) != string(frame(900, 25)) {
+		t.Errorf("parseReplayFrames = % x, want the two frames", frames)
+	}
+	if _, err := parseReplayFrames(strings.NewReader("ff 8")); err == nil {
+		t.Error("parseReplayFrames accepted an odd-length frame")
+	}
+}
+
+// TestReplayPipeline feeds recorded frames through the whole read, filter
+// and send path.
+func TestReplayPipeline(t *testing.T) {
+	bad := frame(700, 24)
+	bad[8]++
+	replay := newReplayPort([][]byte{frame(800, 24), bad, frame(900, 25)}, false)
+	sink := &recordingSink{}
+	d := newTestDaemon(t, replay, sink)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		d.runOnce(ctx)
+	}
+	if err := d.runOnce(ctx); !errors.Is(err, errReplayFinished) {
+		t.Errorf("runOnce after the last frame = %v, want %v", err, errReplayFinished)
+	}
+	if !replay.finished() {
+		t.Error("replay not marked finished")
+	}
+
+	if len(sink.results) != 2 {
+		t.Fatalf("sink got %d readings, want 2", len(sink.results))
+	}
+	for i, want := range []float32{800, 900} {
+		if got := sink.results[i].Co2Concentration; got != want {
+			t.Errorf("reading %d = %v ppm, want %v", i, got, want)
+		}
+	}
+	if entries := d.history.Entries(); len(entries) != 2 {
+		t.Errorf("history holds %d readings, want 2", len(entries))
+	}
+}
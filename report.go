@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// initReportInterval returns REPORT_INTERVAL, how often an averaged point is
+// sent when it is longer than the read interval. Zero means every reading is
+// sent as it is taken. A zero readInterval, as in streaming mode, accepts any
+// positive REPORT_INTERVAL.
+func initReportInterval(readInterval time.Duration) time.Duration {
+	intervalStr, found := os.LookupEnv("REPORT_INTERVAL")
+	if !found || intervalStr == "" {
+		return 0
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil {
+		log.Printf("Invalid REPORT_INTERVAL value: %v, sending every reading", err)
+		return 0
+	}
+	if interval <= readInterval {
+		log.Printf("REPORT_INTERVAL (%v) is not longer than the read interval (%v), sending every reading", interval, readInterval)
+		return 0
+	}
+	if readInterval > 0 {
+		log.Printf("Reading every %v, reporting averages every %v", readInterval, interval)
+	}
+	return interval
+}
+
+// reportWindow averages the readings taken between two reports. Reports are
+// due on a fixed cadence from the first reading, so slow reads don't make
+// windows drift.
+type reportWindow struct {
+	interval time.Duration
+	deadline time.Time
+
+	co2Sum    float64
+	co2Min    float32
+	co2Max    float32
+	count     int
+	tempSum   float64
+	tempCount int
+}
+
+// newReportWindow returns nil when interval is zero.
+func newReportWindow(interval time.Duration) *reportWindow {
+	if interval <= 0 {
+		return nil
+	}
+	return &reportWindow{interval: interval}
+}
+
+// Add accumulates result. When the window is due it returns the averaged
+// result, stamped with the time of the last reading, and starts a new
+// window; otherwise ok is false.
+func (w *reportWindow) Add(result Result) (report Result, ok bool) {
+	if w.deadline.IsZero() {
+		w.deadline = result.Time.Add(w.interval)
+	}
+	co2 := result.Co2Concentration
+	if w.count == 0 || co2 < w.co2Min {
+		w.co2Min = co2
+	}
+	if w.count == 0 || co2 > w.co2Max {
+		w.co2Max = co2
+	}
+	w.co2Sum += float64(co2)
+	w.count++
+	if !result.NoTemperature {
+		w.tempSum += float64(result.Temperature)
+		w.tempCount++
+	}
+	if result.Time.Before(w.deadline) {
+		return Result{}, false
+	}
+
+	report = result
+	report.Co2Concentration = float32(w.co2Sum / float64(w.count))
+	report.Co2Min, report.Co2Max, report.SampleCount = w.co2Min, w.co2Max, w.count
+	if w.tempCount > 0 {
+		report.Temperature = float32(w.tempSum / float64(w.tempCount))
+		report.NoTemperature = false
+	}
+	// Per-reading values don't describe the average.
+	report.Co2Raw = 0
+	report.RawCo2 = 0
+
+	for !result.Time.Before(w.deadline) {
+		w.deadline = w.deadline.Add(w.interval)
+	}
+	w.co2Sum, w.count, w.tempSum, w.tempCount = 0, 0, 0, 0
+	return report, true
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := newReportWindow(time.Minute)
+
+	var reports []Result
+	for i, co2 := range []float32{500, 700, 600, 800} {
+		result := Result{Co2Concentration: co2, Temperature: 20, Time: start.Add(time.Duration(i) * 30 * time.Second)}
+		if report, ok := w.Add(result); ok {
+			reports = append(reports, report)
+		}
+	}
+
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1", len(reports))
+	}
+	got := reports[0]
+	if got.Co2Concentration != 600 || got.Co2Min != 500 || got.Co2Max != 700 || got.SampleCount != 3 {
+		t.Errorf("report = {mean %v, min %v, max %v, count %d}, want {600, 500, 700, 3}",
+			got.Co2Concentration, got.Co2Min, got.Co2Max, got.SampleCount)
+	}
+	if !got.Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("report time = %v, want %v", got.Time, start.Add(time.Minute))
+	}
+
+	// The window reset: the next report covers only the later readings.
+	report, ok := w.Add(Result{Co2Concentration: 1000, Time: start.Add(2 * time.Minute)})
+	if !ok || report.SampleCount != 2 || report.Co2Min != 800 || report.Co2Max != 1000 {
+		t.Errorf("second report = %+v, ok %v; want 2 samples from 800 to 1000", report, ok)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sensorLoop is the per-device state of one reader: its port, its tags and
+// any filter or alert state that must not be shared between sensors.
+type sensorLoop struct {
+	// mu is held for each read cycle and by remote calibration, so their
+	// commands never interleave on the port.
+	mu sync.Mutex
+
+	id         string
+	port       *sensorPort
+	info       InfluxDBInfo
+	correction *co2Correction
+	smoother   co2Filter
+	alerter    *co2Alerter
+	failures   *failureAlerter
+	stuck      *stuckDetector
+	rate       rateTracker
+	report     *reportWindow
+	dedup      *dedupFilter
+	stamps     *timestampAligner
+	step       *stepFilter
+	derived    bool
+	logger     *slog.Logger
+
+	// warnedTemperature is set once the missing-temperature warning has
+	// been logged.
+	warnedTemperature bool
+
+	// trigger requests an out-of-cycle read; see Daemon.watchManualReads.
+	trigger chan struct{}
+}
+
+// newSensorLoop opens the device and applies the startup sensor settings. A
+// non-empty id is attached to every point as the sensor_id tag.
+func newSensorLoop(id string, open func() (io.ReadWriteCloser, error), startupRetries, maxErrors int, info InfluxDBInfo) (*sensorLoop, error) {
+	conn, err := openWithRetry(open, startupRetries)
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.Default()
+	if id != "" {
+		logger = logger.With("sensor_id", id)
+		info.Tags = maps.Clone(info.Tags)
+		info.Tags["sensor_id"] = id
+	}
+	s := &sensorLoop{
+		id: id,
+		// port may swap in a new connection after a reconnect, so close
+		// through it rather than the original handle.
+		port:       newSensorPort(conn, open, maxErrors),
+		info:       info,
+		correction: initCo2Correction(),
+		smoother:   initFilter(),
+		alerter:    initCo2Alerter(),
+		failures:   initFailureAlerter(id),
+		dedup:      initDedupFilter(),
+		step:       initStepFilter(),
+		stuck:      initStuckDetector(),
+		derived:    initDerivedMetrics(),
+		logger:     logger,
+		trigger:    make(chan struct{}, 1),
+	}
+	if initMonotonicTimestamps() {
+		s.stamps = &timestampAligner{}
+	}
+	s.configure()
+	return s, nil
+}
+
+// configure applies the one-off ABC and detection range settings.
+func (s *sensorLoop) configure() {
+	if enable, ok := initABC(); ok {
+		if err := setABC(s.port, enable); err != nil {
+			s.logger.Error("error setting ABC logic", "error", err)
+		} else if enable {
+			s.logger.Info("ABC logic: on")
+		} else {
+			s.logger.Info("ABC logic: off")
+		}
+	}
+
+	if ppm, ok := initDetectionRange(); ok {
+		if err := setRange(s.port, ppm); err != nil {
+			s.logger.Error("error setting detection range", "error", err)
+		} else {
+			s.logger.Info("detection range set", "ppm", ppm)
+		}
+	}
+}
+
+// runSelfTest checks the sensor answers before the loop starts. On failure it
+// logs wiring hints and exits if fatal is set; otherwise the regular
+// retry and reconnect handling takes over.
+func (s *sensorLoop) runSelfTest(cfg readConfig, fatal bool) {
+	err := selfTest(s.port, cfg, selfTestAttempts)
+	if err == nil {
+		s.logger.Info("sensor self-test passed")
+		return
+	}
+	if errors.Is(err, errNoResponse) {
+		s.logger.Error("sensor sent no bytes at all during self-test; TX and RX are probably swapped (sensor TX must go to adapter RX and vice versa), or the sensor is unpowered or UART_DEV is the wrong port", "error", err)
+	} else {
+		s.logger.Error("sensor answered the self-test with partial or garbled frames; this usually means a baud rate mismatch, check UART_BAUD (the MH-Z19C uses 9600)", "error", err)
+	}
+	if fatal {
+		log.Fatal("Exiting because FAIL_ON_SELFTEST is set")
+	}
+}
+
+// run reads the sensor every d.interval, plus up to d.jitter, until ctx is
+// cancelled.
+func (s *sensorLoop) run(ctx context.Context, d *Daemon) {
+	cmd := buildCommand()
+	s.rate.maxGap = 2 * d.interval
+	if s.stamps != nil {
+		s.stamps.interval = d.interval
+	}
+	if s.step != nil {
+		s.step.interval = d.interval
+	}
+	if d.stream && s.stuck != nil {
+		// STUCK_WINDOW counts reads, and streamed frames arrive every
+		// second or two, so a steady room would soon look stuck.
+		s.logger.Info("stuck detection disabled in STREAM_MODE")
+		s.stuck = nil
+	}
+	if d.stream {
+		s.runStream(ctx, d)
+		return
+	}
+	for {
+		s.cycle(ctx, d, cmd)
+		// Manual reads run in between without moving the next regular
+		// one.
+		next := time.After(jitteredSleep(d.interval, d.jitter))
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.trigger:
+				s.logger.Info("manual read requested")
+				s.cycle(ctx, d, cmd)
+			case <-next:
+				break wait
+			}
+		}
+	}
+}
+
+// cycle runs one read-and-send cycle. The sensor speaks a half-duplex
+// request/response protocol, so concurrent access to the port interleaves
+// frames and corrupts both reads. Each cycle therefore runs to completion
+// before the next one starts, and each loop owns its port exclusively.
+func (s *sensorLoop) cycle(ctx context.Context, d *Daemon, cmd []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doIt(ctx, d, s, cmd)
+}
+
+// initUARTDevs returns the devices listed in UART_DEVS, or nil to fall back
+// to the single UART_DEV sensor.
+func initUARTDevs() []string {
+	var devices []string
+	for _, device := range strings.Split(os.Getenv("UART_DEVS"), ",") {
+		if device = strings.TrimSpace(device); device != "" {
+			devices = append(devices, device)
+		}
+	}
+	if len(devices) > 0 {
+		log.Printf("Reading %d sensors: %s", len(devices), strings.Join(devices, ", "))
+	}
+	return devices
+}
+
+// initSensorIDs returns the sensor_id of each device, or of the single
+// UART_DEV sensor when devices is empty. SENSOR_ID takes one id per device,
+// comma-separated; without it, multi-sensor ids are derived from the device
+// names and a single sensor gets no sensor_id tag.
+func initSensorIDs(devices []string) ([]string, error) {
+	ids := splitList(os.Getenv("SENSOR_ID"))
+	if len(devices) == 0 {
+		switch len(ids) {
+		case 0:
+			return []string{""}, nil
+		case 1:
+			log.Printf("Sensor ID: %s", ids[0])
+			return ids, nil
+		default:
+			return nil, fmt.Errorf("SENSOR_ID lists %d ids but only one sensor is configured; use UART_DEVS for several", len(ids))
+		}
+	}
+	if len(ids) == 0 {
+		ids = make([]string, len(devices))
+		for i, device := range devices {
+			ids[i] = sensorIDFromDevice(device)
+		}
+	} else if len(ids) != len(devices) {
+		return nil, fmt.Errorf("SENSOR_ID lists %d ids for %d UART_DEVS devices", len(ids), len(devices))
+	}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate sensor_id %q; set SENSOR_ID to tell the devices apart", id)
+		}
+		seen[id] = true
+	}
+	return ids, nil
+}
+
+// sensorIDFromDevice derives a stable sensor_id from a port name, e.g.
+// /dev/ttyUSB0 becomes ttyUSB0.
+func sensorIDFromDevice(device string) string {
+	return filepath.Base(device)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Sink is a destination for readings. Implementations must be safe for use
+// by several sensor loops at once.
+type Sink interface {
+	Write(ctx context.Context, result *Result) error
+	Close() error
+}
+
+// initSink returns the sink selected by OUTPUT_MODE. With forceBlocking,
+// InfluxDB writes complete before Write returns regardless of
+// INFLUXDB_BLOCKING_WRITES, so their errors are seen.
+func initSink(info InfluxDBInfo, forceBlocking bool) (Sink, string, error) {
+	mode := initOutputMode()
+	co2Field, err := initCo2FieldName()
+	if err != nil {
+		return nil, mode, err
+	}
+	switch mode {
+	case outputStdout:
+		log.Printf("Output mode: stdout, InfluxDB disabled")
+		return newStdoutSink(co2Field), mode, nil
+	case outputCSV:
+		path, err := initCSVFile()
+		if err != nil {
+			return nil, mode, err
+		}
+		sink, err := newCSVSink(path)
+		if err != nil {
+			return nil, mode, err
+		}
+		log.Printf("Output mode: csv (%s), InfluxDB disabled", path)
+		return sink, mode, nil
+	case outputLineProtocol:
+		sink, err := initLineProtocolSink(info, co2Field)
+		if err != nil {
+			return nil, mode, err
+		}
+		log.Printf("Output mode: lineprotocol (%s), InfluxDB disabled", sink.path)
+		return sink, mode, nil
+	default:
+		if err := checkDefaultedTargets(info); err != nil {
+			return nil, mode, err
+		}
+		sink, err := newInfluxSink(info, co2Field, forceBlocking || initBlockingWrites())
+		if err != nil {
+			return nil, mode, err
+		}
+		return sink, mode, nil
+	}
+}
+
+const defaultCo2FieldName = "co2_concentration"
+
+// otherFieldNames are the keys resultFields uses besides the concentration.
+var otherFieldNames = []string{"temperature", "co2_raw", "co2_raw_unlimited", "co2_rate_ppm_per_min", "co2_min", "co2_max", "sample_count", "sensor_status"}
+
+// fieldNamePattern accepts keys that need no escaping in line protocol.
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// initCo2FieldName returns CO2_FIELD_NAME, the field key of the
+// concentration, so readings can go into buckets with an existing schema.
+func initCo2FieldName() (string, error) {
+	name, found := os.LookupEnv("CO2_FIELD_NAME")
+	if !found {
+		return defaultCo2FieldName, nil
+	}
+	if !fieldNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid CO2_FIELD_NAME %q: must start with a letter and contain only letters, digits and underscores", name)
+	}
+	if slices.Contains(otherFieldNames, name) {
+		return "", fmt.Errorf("invalid CO2_FIELD_NAME %q: clashes with another field", name)
+	}
+	return name, nil
+}
+
+// resultFields returns the fields recorded for result, with the
+// concentration under co2Field.
+func resultFields(result *Result, co2Field string) map[string]interface{} {
+	fields := map[string]interface{}{
+		co2Field: result.Co2Concentration,
+	}
+	if !result.NoTemperature {
+		fields["temperature"] = result.Temperature
+	}
+	if result.Co2Raw != 0 {
+		fields["co2_raw"] = result.Co2Raw
+	}
+	if unclampedDiffers(result) {
+		fields["co2_raw_unlimited"] = result.RawCo2
+	}
+	if result.HasCo2Rate {
+		fields["co2_rate_ppm_per_min"] = result.Co2Rate
+	}
+	if result.SampleCount > 0 {
+		fields["co2_min"] = result.Co2Min
+		fields["co2_max"] = result.Co2Max
+		fields["sample_count"] = int64(result.SampleCount)
+	}
+	if !statusNominal(result.Status) {
+		fields["sensor_status"] = int64(result.Status)
+	}
+	for key, value := range result.Derived {
+		if _, taken := fields[key]; !taken {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// influxSink writes each reading as one point to InfluxDB.
+type influxSink struct {
+	client      influxdb2.Client
+	writer      pointWriter
+	measurement string
+	// temperatureMeasurement splits temperature into its own point when
+	// set.
+	temperatureMeasurement string
+	co2Field               string
+	// serverTimestamp leaves points unstamped for the server to stamp.
+	serverTimestamp bool
+	writeTimeout    time.Duration
+}
+
+func newInfluxSink(info InfluxDBInfo, co2Field string, blocking bool) (*influxSink, error) {
+	client, err := initClient(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := probeInflux(client, info, initInfluxStartupRetries()); err != nil {
+		client.Close()
+		return nil, err
+	}
+	buffer := initDiskBuffer()
+	serverTimestamp := initServerTimestamp()
+	if serverTimestamp {
+		log.Printf("InfluxDB assigns timestamps on receipt")
+		if buffer != nil {
+			log.Printf("WARNING: with INFLUXDB_SERVER_TIMESTAMP, readings replayed from BUFFER_FILE are stamped with the replay time")
+		}
+	}
+	return &influxSink{
+		client:                 client,
+		writer:                 newPointWriter(client, info, blocking, buffer),
+		measurement:            info.Measurement,
+		temperatureMeasurement: info.TemperatureMeasurement,
+		co2Field:               co2Field,
+		serverTimestamp:        serverTimestamp,
+		writeTimeout:           initWriteTimeout(),
+	}, nil
+}
+
+// initStrictConfig reports whether STRICT_CONFIG is set, turning settings
+// that would otherwise fall back to a default into startup errors.
+func initStrictConfig() bool {
+	strictStr, found := os.LookupEnv("STRICT_CONFIG")
+	if !found {
+		return false
+	}
+	strict, err := strconv.ParseBool(strictStr)
+	if err != nil {
+		log.Printf("Invalid STRICT_CONFIG value: %v, disabling strict config", err)
+		return false
+	}
+	return strict
+}
+
+// checkDefaultedTargets warns about an org or bucket left at its built-in
+// default, which is unlikely to exist on the user's server, and fails with
+// STRICT_CONFIG.
+func checkDefaultedTargets(info InfluxDBInfo) error {
+	if len(info.Defaulted) == 0 {
+		return nil
+	}
+	if initStrictConfig() {
+		return fmt.Errorf("%s not set (required with STRICT_CONFIG)", strings.Join(info.Defaulted, " and "))
+	}
+	log.Printf("WARNING: %s not set, writing to the built-in default org %q, bucket %q; set them explicitly, or STRICT_CONFIG=1 to make this an error", strings.Join(info.Defaulted, " and "), info.Org, info.Bucket)
+	return nil
+}
+
+// initTemperatureMeasurement returns TEMPERATURE_MEASUREMENT (default
+// "temperature") when SPLIT_MEASUREMENTS is set, and "" to keep
+// temperature in the same point as CO2.
+func initTemperatureMeasurement() string {
+	splitStr, found := os.LookupEnv("SPLIT_MEASUREMENTS")
+	if !found {
+		return ""
+	}
+	split, err := strconv.ParseBool(splitStr)
+	if err != nil {
+		log.Printf("Invalid SPLIT_MEASUREMENTS value: %v, writing a single measurement", err)
+		return ""
+	}
+	if !split {
+		return ""
+	}
+	measurement := os.Getenv("TEMPERATURE_MEASUREMENT")
+	if measurement == "" {
+		measurement = "temperature"
+	}
+	return measurement
+}
+
+// newResultPoints encodes result as the points written by the InfluxDB and
+// line-protocol outputs: a single point, or with a temperatureMeasurement a
+// second one carrying the temperature under the same tags and time.
+func newResultPoints(measurement, temperatureMeasurement, co2Field string, result *Result) []*write.Point {
+	fields := resultFields(result, co2Field)
+	if temperatureMeasurement == "" {
+		return []*write.Point{write.NewPoint(measurement, result.Tags, fields, result.Time)}
+	}
+	temperature, ok := fields["temperature"]
+	delete(fields, "temperature")
+	points := []*write.Point{write.NewPoint(measurement, result.Tags, fields, result.Time)}
+	if ok {
+		points = append(points, write.NewPoint(temperatureMeasurement, result.Tags, map[string]interface{}{"temperature": temperature}, result.Time))
+	}
+	return points
+}
+
+func (s *influxSink) Write(ctx context.Context, result *Result) error {
+	points := newResultPoints(s.measurement, s.temperatureMeasurement, s.co2Field, result)
+	if s.serverTimestamp {
+		// Points with a zero time are encoded without a timestamp.
+		for _, point := range points {
+			point.SetTime(time.Time{})
+		}
+	}
+	return s.WritePoint(ctx, points...)
+}
+
+// WritePoint writes points as they are, for points other than readings. A
+// write still running after writeTimeout is abandoned and fails like any
+// other, so it is buffered to disk when that is enabled.
+func (s *influxSink) WritePoint(ctx context.Context, points ...*write.Point) error {
+	ctx, cancel := context.WithTimeout(ctx, s.writeTimeout)
+	defer cancel()
+	start := time.Now()
+	err := s.writer.WritePoint(ctx, points...)
+	influxWriteSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		influxWriteFailuresTotal.Inc()
+		return fmt.Errorf("failed to write point: %w", err)
+	}
+	return nil
+}
+
+// Close flushes any pending writes.
+func (s *influxSink) Close() error {
+	s.client.Close()
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// streamReadTimeout is how long a streaming sensor may stay silent before
+// the read counts as failed. Sensors in auto-output mode send a frame about
+// every second or two.
+const streamReadTimeout = 5 * time.Second
+
+// initStreamMode reports whether STREAM_MODE is set, for sensors that send
+// frames on their own instead of answering the read command.
+func initStreamMode() bool {
+	streamStr, found := os.LookupEnv("STREAM_MODE")
+	if !found {
+		return false
+	}
+	stream, err := strconv.ParseBool(streamStr)
+	if err != nil {
+		log.Printf("Invalid STREAM_MODE value: %v, polling the sensor", err)
+		return false
+	}
+	return stream
+}
+
+// readStreamed waits for the next frame the sensor sends unprompted.
+func readStreamed(dev io.Reader, cfg readConfig) (_ Result, err error) {
+	readsTotal.Inc()
+	defer func() {
+		if err != nil {
+			readErrorsTotal.Inc()
+		}
+	}()
+	cfg.ReadTimeout = streamReadTimeout
+	return readResponse(dev, cmdRead, cfg)
+}
+
+// streamCycle reads one streamed frame and handles it like a polled reading.
+func streamCycle(ctx context.Context, d *Daemon, s *sensorLoop) (err error) {
+	defer recoverCycle(s, &err)
+	result, err := readStreamed(s.port, d.readCfg)
+	return handleReading(ctx, d, s, result, err)
+}
+
+// runStream handles every frame as it arrives until ctx is cancelled. How
+// often readings are sent is up to the report window.
+func (s *sensorLoop) runStream(ctx context.Context, d *Daemon) {
+	// Whatever arrived before startup may be a partial frame.
+	flushInput(s.port)
+	for ctx.Err() == nil {
+		s.mu.Lock()
+		streamCycle(ctx, d, s)
+		s.mu.Unlock()
+	}
+}
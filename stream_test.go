@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// streamingSerial sends the same frame over and over, like a sensor in
+// auto-output mode in a steady room.
+type streamingSerial struct {
+	frame   []byte
+	pending []byte
+}
+
+func (f *streamingSerial) Read(b []byte) (int, error) {
+	if len(f.pending) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		f.pending = f.frame
+	}
+	n := copy(b, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (f *streamingSerial) Write(b []byte) (int, error) { return len(b), nil }
+func (f *streamingSerial) Close() error                { return nil }
+
+func TestStreamModeDisablesStuckDetection(t *testing.T) {
+	t.Setenv("STUCK_WINDOW", "2")
+	t.Setenv("STUCK_RECONNECT", "true")
+	dev := &streamingSerial{frame: frame(650, 22)}
+	d := newTestDaemon(t, dev, &recordingSink{})
+	d.stream = true
+	s := d.loops[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	d.run(ctx)
+
+	if s.stuck != nil {
+		t.Error("stuck detector still active in stream mode")
+	}
+	if entries := d.history.Entries(); len(entries) < 3 {
+		t.Errorf("history holds %d readings, want at least 3 identical frames", len(entries))
+	}
+}
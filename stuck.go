@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// stuckDetector flags a sensor that returns the exact same response frame
+// for window consecutive reads. Comparing raw bytes rather than the
+// concentration avoids false positives in genuinely stable rooms, where the
+// temperature or checksum bytes still move.
+type stuckDetector struct {
+	window    int
+	reconnect bool
+	last      [cmdSize]byte
+	count     int
+}
+
+// Observe records frame and reports true once per stuck episode, when the
+// same frame has been seen window times in a row and again every window
+// reads while it persists.
+func (d *stuckDetector) Observe(frame [cmdSize]byte) bool {
+	if d.count > 0 && frame == d.last {
+		d.count++
+	} else {
+		d.last = frame
+		d.count = 1
+	}
+	return d.count%d.window == 0
+}
+
+// initStuckDetector returns nil when STUCK_WINDOW is 0. STUCK_RECONNECT
+// additionally reopens the port when the sensor appears stuck. The window
+// counts polled reads, so the detector is dropped in STREAM_MODE.
+func initStuckDetector() *stuckDetector {
+	windowStr, found := os.LookupEnv("STUCK_WINDOW")
+	if !found {
+		windowStr = "10"
+	}
+	window, err := strconv.Atoi(windowStr)
+	if err != nil || window < 0 {
+		log.Printf("Invalid STUCK_WINDOW value: %q, defaulting to 10", windowStr)
+		window = 10
+	}
+	if window == 0 {
+		return nil
+	}
+	if window == 1 {
+		log.Printf("STUCK_WINDOW must be at least 2, defaulting to 10")
+		window = 10
+	}
+	reconnect := false
+	if reconnectStr, found := os.LookupEnv("STUCK_RECONNECT"); found {
+		reconnect, err = strconv.ParseBool(reconnectStr)
+		if err != nil {
+			log.Printf("Invalid STUCK_RECONNECT value: %v, defaulting to false", err)
+		}
+	}
+	return &stuckDetector{window: window, reconnect: reconnect}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state to the service manager over NOTIFY_SOCKET, using the
+// sd_notify datagram protocol. It does nothing when not run under systemd.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to NOTIFY_SOCKET: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify service manager: %v", err)
+	}
+	return nil
+}
+
+// notifyReady tells systemd that startup has finished. It is called after
+// every successful reading but only notifies once.
+func (d *Daemon) notifyReady() {
+	d.ready.Do(func() {
+		if err := sdNotify("READY=1"); err != nil {
+			slog.Error("error sending readiness notification", "error", err)
+		}
+	})
+}
+
+// watchdogInterval returns the WatchdogSec= of the unit, from WATCHDOG_USEC,
+// or zero when the watchdog is off or meant for another process.
+func watchdogInterval() time.Duration {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil || usec <= 0 {
+		log.Printf("Invalid WATCHDOG_USEC value: %q, not pinging the watchdog", usecStr)
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog at half its interval for as long as
+// read cycles keep completing, so a wedged loop gets the process restarted.
+// Failing reads and reconnect attempts still count as progress: a restart
+// would not bring back an unplugged sensor.
+func (d *Daemon) runWatchdog(ctx context.Context) {
+	interval := watchdogInterval()
+	if interval == 0 || os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	// Reconnect attempts may be up to RECONNECT_MAX_BACKOFF apart.
+	staleAfter := max(2*(d.interval+d.jitter), initReconnectMaxBackoff()) + time.Minute
+	slog.Info("systemd watchdog enabled, pinging while reads progress", "ping_interval", (interval / 2).String())
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			last := heartbeat.lastRead.Load()
+			if last == 0 {
+				// Still starting up; systemd only enforces the
+				// watchdog once READY=1 has been sent.
+				continue
+			}
+			if age := time.Since(time.Unix(last, 0)); age > staleAfter {
+				slog.Warn("no read cycle completed recently, withholding watchdog ping", "age", age.Round(time.Second).String())
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Error("error pinging watchdog", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// timestampAligner stamps readings at base + n*interval, with n the number
+// of intervals since the first reading, so the series is evenly spaced
+// despite scheduling jitter. If the aligned time strays more than one
+// interval from the wall clock, e.g. after the clock was set, it re-anchors
+// on the current reading.
+type timestampAligner struct {
+	interval time.Duration
+
+	base     time.Time
+	lastSlot int64
+}
+
+// Stamp returns the aligned timestamp for a reading taken at now.
+func (a *timestampAligner) Stamp(now time.Time) time.Time {
+	if a.interval <= 0 {
+		return now
+	}
+	if a.base.IsZero() {
+		a.base = now
+		a.lastSlot = 0
+		return now
+	}
+	// The slot comes from the monotonic clock; the drift check uses wall
+	// time so clock adjustments are noticed.
+	elapsed := now.Sub(a.base)
+	slot := int64((elapsed + a.interval/2) / a.interval)
+	stamp := a.base.Add(time.Duration(slot) * a.interval)
+	if drift := stamp.Round(0).Sub(now.Round(0)); drift > a.interval || drift < -a.interval {
+		slog.Warn("aligned timestamp drifted from the wall clock, re-anchoring", "drift", drift.String())
+		a.base = now
+		a.lastSlot = 0
+		return now
+	}
+	if slot <= a.lastSlot {
+		// An extra read, e.g. on SIGUSR1, must not overwrite the point
+		// already written for this slot.
+		return now
+	}
+	a.lastSlot = slot
+	return stamp
+}
+
+// initMonotonicTimestamps reports whether MONOTONIC_TIMESTAMPS is set.
+func initMonotonicTimestamps() bool {
+	enabledStr, found := os.LookupEnv("MONOTONIC_TIMESTAMPS")
+	if !found {
+		return false
+	}
+	enabled, err := strconv.ParseBool(enabledStr)
+	if err != nil {
+		log.Printf("Invalid MONOTONIC_TIMESTAMPS value: %v, using wall-clock timestamps", err)
+		return false
+	}
+	return enabled
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAlignedTimestampKeepsWallClockFreshness(t *testing.T) {
+	d := newTestDaemon(t, newReplayPort([][]byte{frame(650, 22)}, true), &recordingSink{})
+	d.interval = time.Hour
+	s := d.loops[0]
+	// Anchored 50 minutes ago, the reading is aligned to the next slot, 10
+	// minutes ahead of the wall clock.
+	s.stamps = &timestampAligner{interval: time.Hour, base: time.Now().Add(-50 * time.Minute)}
+
+	before := time.Now()
+	if err := d.runOnce(context.Background()); err != nil {
+		t.Fatalf("runOnce returned error: %v", err)
+	}
+	result, timestamp, ok := d.latest.Get()
+	if !ok {
+		t.Fatal("no latest reading")
+	}
+	if want := s.stamps.base.Add(time.Hour); !result.Time.Equal(want) {
+		t.Errorf("point time = %v, want aligned %v", result.Time, want)
+	}
+	if timestamp.Before(before) || timestamp.After(time.Now()) {
+		t.Errorf("latest timestamp = %v, want the wall-clock read time", timestamp)
+	}
+}
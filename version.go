@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+// Build information, set at link time with e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("sensor-to-db %s (commit %s, built %s)", version, commit, date)
+}